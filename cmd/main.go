@@ -2,22 +2,34 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"log/slog"
 	tcpmeasurer "orchestrator/common/pkg/tcp_measurer"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"syscall"
 	"time"
 
 	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
+	"github.com/joho/godotenv"
 )
 
 var (
-	appPortStr = "8080"
-	skipCMD    = "0"
+	appPortStr      = "8080"
+	skipCMD         = "0"
+	captureMode     = "tcpdump"
+	latencyUnit     = "ms"
+	maxHosts        = "100000"
+	shards          = "0"   // 0 is GOMAXPROCS
+	allowedLateness = "1m"  // window is closed when packets this much later than its end are captured
+	metricsAddr     = ""    // prometheus listener is disabled by default, e.g. ":9100"
+	resultsFile     = ""    // json lines file with window results, e.g. "/var/log/tcpmeasurer/results.jsonl"
+	webhookURL      = ""    // window results are posted as json array
+	notifyLatency   = "0"   // "1" measures mining.notify propagation to miners, snap length is raised to capture job id
+	timestampRTT    = "0"   // "1" estimates RTT by TCP timestamps next to ack == seq matching
+	idleTimeout     = "10m" // connection without packets is evicted from the connection table
 )
 
 func main() {
@@ -28,21 +40,74 @@ func main() {
 	if err != nil {
 		appLogger.Fatal("unable to parse app port", err)
 	}
-	appLogger.Info("app starting", slog.String("port", appPortStr))
+	unit, err := tcpmeasurer.ParseLatencyUnit(latencyUnit)
+	if err != nil {
+		appLogger.Fatal("unable to parse latency unit", err)
+	}
+	lateness, err := time.ParseDuration(allowedLateness)
+	if err != nil {
+		appLogger.Fatal("unable to parse allowed lateness", err)
+	}
+	connectionIdleTimeout, err := time.ParseDuration(idleTimeout)
+	if err != nil {
+		appLogger.Fatal("unable to parse connection idle timeout", err)
+	}
+	hostsLimit, err := strconv.Atoi(maxHosts)
+	if err != nil {
+		appLogger.Fatal("unable to parse max hosts", err)
+	}
+	shardCount, err := strconv.Atoi(shards)
+	if err != nil {
+		appLogger.Fatal("unable to parse shards", err)
+	}
+	loadEnv(appLogger)
+	var coinRules []tcpmeasurer.CoinRule
+	if rulesFile := os.Getenv("COIN_RULES"); rulesFile != "" {
+		if coinRules, err = tcpmeasurer.LoadCoinRules(rulesFile); err != nil {
+			appLogger.Fatal("unable to load coin rules", err)
+		}
+	}
+	appLogger.Info(
+		"app starting",
+		slog.String("port", appPortStr),
+		slog.String("capture_mode", captureMode),
+		slog.String("latency_unit", latencyUnit),
+		slog.Duration("allowed_lateness", lateness),
+		slog.Duration("connection_idle_timeout", connectionIdleTimeout),
+		slog.Int("max_hosts", hostsLimit),
+		slog.Int("shards", shardCount),
+		slog.String("metrics_addr", metricsAddr),
+		slog.Bool("notify_propagation", notifyLatency == "1"),
+		slog.Bool("timestamp_rtt", timestampRTT == "1"),
+		slog.String("default_coin", os.Getenv("COIN")),
+		slog.Int("coin_rules", len(coinRules)),
+	)
 
-	srv := tcpmeasurer.NewService(ctx, appLogger, uint64(appPort), tcpmeasurer.WithSkipCMD(skipCMD))
+	srv := tcpmeasurer.NewService(
+		ctx,
+		appLogger,
+		uint64(appPort),
+		tcpmeasurer.WithSkipCMD(skipCMD),
+		tcpmeasurer.WithCaptureMode(captureMode),
+		tcpmeasurer.WithLatencyUnit(unit),
+		tcpmeasurer.WithAllowedLateness(lateness),
+		tcpmeasurer.WithConnectionIdleTimeout(connectionIdleTimeout),
+		tcpmeasurer.WithMaxHosts(hostsLimit),
+		tcpmeasurer.WithShards(shardCount),
+		tcpmeasurer.WithDefaultCoin(os.Getenv("COIN")),
+		tcpmeasurer.WithCoinRules(coinRules...),
+		tcpmeasurer.WithMetricsAddr(metricsAddr),
+		tcpmeasurer.WithNotifyPropagation(notifyLatency == "1"),
+		tcpmeasurer.WithTimestampRTT(timestampRTT == "1"),
+		tcpmeasurer.WithSinks(newSinks(appLogger)...),
+	)
 	if err = srv.Init(); err != nil {
 		appLogger.Fatal("unable to init service", err)
 	}
 
 	go func() {
-		time.Sleep(6 * time.Hour)
-		appLogger.Fatal("app shutting down due to timeout", fmt.Errorf("timeout"))
-	}()
-
-	go func() {
-		if err = srv.Start(); err != nil {
-			appLogger.Fatal("unable to start service", err)
+		if errS := srv.Start(); errS != nil && ctx.Err() == nil {
+			appLogger.Fatal("unable to start service", errS)
 		}
 	}()
 
@@ -52,7 +117,30 @@ func main() {
 	<-c // This blocks the main thread until an interrupt is received
 	appLogger.Info("app shutting down")
 	cancel()
-	srv.Stop()
+	srv.Stop() // waits until capture files are parsed and all windows are written
+}
+
+// loadEnv reads ~/.env written by `make install_service`, variables of the environment take precedence
+func loadEnv(appLogger logger.AppLogger) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		appLogger.Error("unable to find home dir", err)
+		return
+	}
+	if err = godotenv.Load(filepath.Join(home, ".env")); err != nil && !os.IsNotExist(err) {
+		appLogger.Fatal("unable to load .env", err)
+	}
+}
+
+func newSinks(appLogger logger.AppLogger) []tcpmeasurer.Sink {
+	sinks := []tcpmeasurer.Sink{tcpmeasurer.NewLogSink(appLogger.With(slog.String("service", "tcpmeasurer")))}
+	if resultsFile != "" {
+		sinks = append(sinks, tcpmeasurer.NewJSONLinesSink(resultsFile))
+	}
+	if webhookURL != "" {
+		sinks = append(sinks, tcpmeasurer.NewWebhookSink(webhookURL, 10*time.Second))
+	}
+	return sinks
 }
 
 func newLogger() logger.AppLogger {
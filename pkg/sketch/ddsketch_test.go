@@ -0,0 +1,139 @@
+package sketch_test
+
+import (
+	"math"
+	"math/rand"
+	"orchestrator/common/pkg/sketch"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// exactQuantile uses the same rank definition as the sketch: lower value of q*(n-1)
+func exactQuantile(sorted []float64, q float64) float64 {
+	return sorted[int(q*float64(len(sorted)-1))]
+}
+
+func TestDDSketch_Quantile(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	distributions := map[string]func() float64{
+		"uniform 30-40ms": func() float64 { return 30e6 + rnd.Float64()*10e6 },
+		"lognormal":       func() float64 { return math.Exp(rnd.NormFloat64()*2 + 17) },
+		"colocated 50µs":  func() float64 { return 50e3 + rnd.ExpFloat64()*20e3 },
+		"with zeros": func() float64 {
+			if rnd.Intn(10) == 0 {
+				return 0
+			}
+			return 1 + rnd.Float64()*1e9
+		},
+	}
+	for name, next := range distributions {
+		t.Run(name, func(t *testing.T) {
+			sk := sketch.MustNew(0.01, 2048)
+			values := make([]float64, 10_000)
+			sum := 0.0
+			for i := range values {
+				values[i] = next()
+				sum += values[i]
+				sk.Add(values[i])
+			}
+			sort.Float64s(values)
+
+			require.Equal(t, uint64(len(values)), sk.Count())
+			require.Equal(t, values[0], sk.Min())
+			require.Equal(t, values[len(values)-1], sk.Max())
+			require.InEpsilon(t, sum/float64(len(values)), sk.Mean(), 1e-9)
+			for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.75, 0.95, 0.99, 0.999, 1} {
+				expected := exactQuantile(values, q)
+				if expected == 0 {
+					require.Zero(t, sk.Quantile(q))
+					continue
+				}
+				require.InEpsilon(t, expected, sk.Quantile(q), 0.01, "quantile %v", q)
+			}
+		})
+	}
+}
+
+func TestDDSketch_Merge(t *testing.T) {
+	// given
+	rnd := rand.New(rand.NewSource(7))
+	whole := sketch.MustNew(0.01, 2048)
+	parts := []*sketch.DDSketch{sketch.MustNew(0.01, 2048), sketch.MustNew(0.01, 2048), sketch.MustNew(0.01, 2048)}
+	for i := 0; i < 3000; i++ {
+		value := float64(i%3+1) * 1e6 * (1 + rnd.Float64()) // every part has own range
+		whole.Add(value)
+		parts[i%3].Add(value)
+	}
+
+	// when
+	merged := sketch.MustNew(0.01, 2048)
+	for _, part := range parts {
+		require.NoError(t, merged.Merge(part))
+	}
+
+	// then
+	require.Equal(t, whole.Count(), merged.Count())
+	require.Equal(t, whole.Min(), merged.Min())
+	require.Equal(t, whole.Max(), merged.Max())
+	require.InEpsilon(t, whole.Sum(), merged.Sum(), 1e-9)
+	for _, q := range []float64{0.1, 0.5, 0.95, 0.99} {
+		require.Equal(t, whole.Quantile(q), merged.Quantile(q))
+	}
+	require.Equal(t, uint64(1000), parts[0].Count(), "merge should not modify source")
+	require.ErrorIs(t, merged.Merge(sketch.MustNew(0.02, 2048)), sketch.ErrIncompatible)
+	require.NoError(t, merged.Merge(sketch.MustNew(0.01, 2048)))
+	require.Equal(t, whole.Count(), merged.Count())
+}
+
+func TestDDSketch_MaxBuckets(t *testing.T) {
+	sk := sketch.MustNew(0.01, 100)
+	values := make([]float64, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		value := math.Pow(1.05, float64(i%500)) // range is far wider than 100 buckets
+		values = append(values, value)
+		sk.Add(value)
+	}
+	sort.Float64s(values)
+
+	require.LessOrEqual(t, sk.Buckets(), 100)
+	require.Equal(t, values[0], sk.Min())
+	require.Equal(t, values[len(values)-1], sk.Max())
+	for _, q := range []float64{0.95, 0.99} {
+		require.InEpsilon(t, exactQuantile(values, q), sk.Quantile(q), 0.01, "high quantiles keep accuracy")
+	}
+}
+
+func TestDDSketch_Empty(t *testing.T) {
+	sk := sketch.MustNew(0.01, 2048)
+	require.Zero(t, sk.Count())
+	require.Zero(t, sk.Mean())
+	require.Zero(t, sk.Quantile(0.5))
+	sk.Add(math.NaN())
+	require.Zero(t, sk.Count())
+}
+
+func TestNew(t *testing.T) {
+	for _, alpha := range []float64{0, 1, -0.1, math.NaN()} {
+		_, err := sketch.New(alpha, 2048)
+		require.Error(t, err, "alpha %v", alpha)
+	}
+	_, err := sketch.New(0.01, 0)
+	require.Error(t, err)
+	require.Panics(t, func() { sketch.MustNew(2, 2048) })
+}
+
+func BenchmarkDDSketch_Add(b *testing.B) {
+	sk := sketch.MustNew(0.01, 2048)
+	rnd := rand.New(rand.NewSource(1))
+	values := make([]float64, 1024)
+	for i := range values {
+		values[i] = 30e6 + rnd.ExpFloat64()*5e6
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sk.Add(values[i&1023])
+	}
+}
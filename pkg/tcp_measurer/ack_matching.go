@@ -0,0 +1,70 @@
+package tcpmeasurer
+
+import "time"
+
+// stratum segments are kept by end sequence number until ACK of the miner covers them. ACK may cover several segments
+// when miner acknowledges them at once or with delayed ACK, and may come with data of the miner, e.g. mining.submit.
+// Sample is taken from the earliest segment which is acknowledged, so it is the time data was waiting for the ACK.
+// ACK which covers retransmitted segment gives no sample, see retransmissions.go.
+
+// seqAfterOrEqual compares sequence numbers with 32-bit wraparound, see RFC 1982
+func seqAfterOrEqual(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
+
+// trackSegment saves stratum segment with data, retransmitted segment marks segments it overlaps as retransmitted too
+func (s *shard) trackSegment(key connKey, seq, endSeq uint32, mc MeasurerContainer) {
+	if _, ok := s.dataSeq[key]; !ok {
+		s.dataSeq[key] = make(map[uint32]MeasurerContainer, 16)
+	}
+	if prev, ok := s.dataSeq[key][endSeq]; ok {
+		if mc.JobID == "" {
+			mc.JobID = prev.JobID
+		}
+		mc.Retransmitted = true
+	} else if makeRoom(s.dataSeq[key], endSeq, s.maxHostEntries, segmentSentAt) {
+		s.metrics.entriesEvicted.Add(1)
+	}
+	if mc.Retransmitted {
+		for prevEnd, prev := range s.dataSeq[key] {
+			if !seqAfterOrEqual(seq, prevEnd) && seqAfterOrEqual(endSeq, prevEnd) {
+				prev.Retransmitted = true
+				s.dataSeq[key][prevEnd] = prev
+			}
+		}
+	}
+	s.dataSeq[key][endSeq] = mc
+}
+
+// resolveACK removes stratum segments covered by ACK of the miner and saves latency of the earliest one,
+// it returns false if ACK covers nothing, e.g. it is window update or duplicate ACK
+func (s *shard) resolveACK(eventTime time.Time, key connKey, ack uint32) bool {
+	var (
+		sentAt        time.Time
+		retransmitted bool
+		jobs          []string
+	)
+	for endSeq, mc := range s.dataSeq[key] {
+		if !seqAfterOrEqual(ack, endSeq) {
+			continue
+		}
+		if sentAt.IsZero() || mc.EventTime.Before(sentAt) {
+			sentAt = mc.EventTime
+		}
+		retransmitted = retransmitted || mc.Retransmitted
+		if mc.JobID != "" {
+			jobs = append(jobs, mc.JobID)
+		}
+		delete(s.dataSeq[key], endSeq)
+	}
+	if sentAt.IsZero() {
+		return false
+	}
+	if !retransmitted {
+		s.addLatency(eventTime, key, eventTime.Sub(sentAt))
+	}
+	for _, jobID := range jobs {
+		s.addDelivery(jobID, key, eventTime)
+	}
+	return true
+}
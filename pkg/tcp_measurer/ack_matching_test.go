@@ -0,0 +1,98 @@
+package tcpmeasurer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeqAfterOrEqual(t *testing.T) {
+	require.True(t, seqAfterOrEqual(100, 100))
+	require.True(t, seqAfterOrEqual(101, 100))
+	require.False(t, seqAfterOrEqual(99, 100))
+	require.True(t, seqAfterOrEqual(0x10, 0xfffffff0), "wraparound")
+	require.False(t, seqAfterOrEqual(0xfffffff0, 0x10))
+}
+
+func TestService_ResolveACK(t *testing.T) {
+	sentAt := time.Date(2024, 5, 31, 13, 43, 44, 0, time.UTC)
+	window := time.Date(2024, 5, 31, 13, 40, 0, 0, time.UTC)
+	type send struct {
+		after   time.Duration
+		segment testSegment
+	}
+	response := func(after time.Duration, seq uint32) send {
+		return send{after: after, segment: testSegment{src: testStratum, dst: testMiner, seq: seq, ack: 100, flags: tcpFlagACK | tcpFlagPSH, payload: testPayload}}
+	}
+	confirmation := func(after time.Duration, ack uint32) send {
+		return send{after: after, segment: testSegment{src: testMiner, dst: testStratum, seq: 100, ack: ack, flags: tcpFlagACK}}
+	}
+	length := uint32(len(testPayload))
+	table := map[string]struct {
+		packets   []send
+		latencies []time.Duration
+		pending   int
+		unmatched uint64
+	}{
+		"exact ack": {
+			packets:   []send{response(0, 1000), confirmation(40*time.Millisecond, 1000+length)},
+			latencies: []time.Duration{40 * time.Millisecond},
+		},
+		"coalesced ack takes the earliest segment": {
+			packets:   []send{response(0, 1000), response(time.Millisecond, 1000+length), response(2*time.Millisecond, 1000+2*length), confirmation(40*time.Millisecond, 1000+3*length)},
+			latencies: []time.Duration{40 * time.Millisecond},
+		},
+		"partial ack": {
+			packets:   []send{response(0, 1000), response(time.Millisecond, 1000+length), confirmation(40*time.Millisecond, 1000+length+10), confirmation(50*time.Millisecond, 1000+2*length)},
+			latencies: []time.Duration{40 * time.Millisecond, 49 * time.Millisecond},
+		},
+		"ack before the segment end": {
+			packets:   []send{response(0, 1000), confirmation(40*time.Millisecond, 1000+length-1)},
+			pending:   1,
+			unmatched: 1,
+		},
+		"piggybacked on submit": {
+			packets: []send{response(0, 1000), {after: 35 * time.Millisecond, segment: testSegment{src: testMiner, dst: testStratum, seq: 100, ack: 1000 + length, flags: tcpFlagACK | tcpFlagPSH,
+				payload: []byte(`{"id":5,"method":"mining.submit","params":["wg1.rig","BSV-1","00","01","02"]}` + "\n")}}},
+			latencies: []time.Duration{35 * time.Millisecond},
+		},
+		"wraparound": {
+			packets:   []send{response(0, 0xffffffff-10), confirmation(20*time.Millisecond, 0xffffffff), confirmation(40*time.Millisecond, length-11)},
+			latencies: []time.Duration{40 * time.Millisecond},
+			unmatched: 1,
+		},
+		"duplicate ack": {
+			packets:   []send{response(0, 1000), confirmation(40*time.Millisecond, 1000+length), confirmation(41*time.Millisecond, 1000+length)},
+			latencies: []time.Duration{40 * time.Millisecond},
+			unmatched: 1,
+		},
+		"retransmitted segment gives no sample": {
+			packets: []send{response(0, 1000), response(200*time.Millisecond, 1000), confirmation(240*time.Millisecond, 1000+length)},
+		},
+		"ack after retransmission takes segments sent once": {
+			packets:   []send{response(0, 1000), response(time.Millisecond, 1000+length), response(200*time.Millisecond, 1000), confirmation(240*time.Millisecond, 1000+length), confirmation(250*time.Millisecond, 1000+2*length)},
+			latencies: []time.Duration{249 * time.Millisecond},
+		},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestService(t)
+			for _, p := range tc.packets {
+				replaySegments(t, srv, sentAt.Add(p.after), p.segment)
+			}
+
+			latency := srv.shards[0].buffer[window][connKey{miner: testMiner, stratum: testStratum}]
+			if len(tc.latencies) == 0 {
+				require.Nil(t, latency)
+			} else {
+				require.NotNil(t, latency)
+				require.Equal(t, uint64(len(tc.latencies)), latency.Count())
+				require.Equal(t, float64(tc.latencies[0]), latency.Min())
+				require.Equal(t, float64(tc.latencies[len(tc.latencies)-1]), latency.Max())
+			}
+			require.Len(t, srv.shards[0].dataSeq[connKey{miner: testMiner, stratum: testStratum}], tc.pending)
+			require.Equal(t, tc.unmatched, srv.metrics.unmatchedACKs.Load())
+		})
+	}
+}
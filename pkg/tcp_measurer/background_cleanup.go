@@ -15,15 +15,19 @@ func (s *Service) CleanOld() {
 	}
 }
 
+// CleanIt drops matching state which is older than maxIdleAge by event time, see limits.go
 func (s *Service) CleanIt() {
-	dropBefore := time.Now().Add(-5 * time.Minute)
-	s.dataMUSeq.Lock()
-	defer s.dataMUSeq.Unlock()
-	for remoteHost := range s.dataSeq {
-		for key := range s.dataSeq[remoteHost] {
-			if s.dataSeq[remoteHost][key].EventTime.Before(dropBefore) {
-				delete(s.dataSeq[remoteHost], key)
-			}
-		}
+	watermark := s.eventWatermark()
+	dropBefore := watermark.Add(-s.maxIdleAge)
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.expireHandshakes(watermark)
+		dropped := dropStale(sh.dataSeq, dropBefore, segmentSentAt)
+		// submits without response, e.g. response is lost or connection is closed
+		dropped += dropStale(sh.submits, dropBefore, timeOf)
+		dropped += dropStale(sh.submitsSeq, dropBefore, timeOf)
+		dropped += dropStale(sh.tsSent, dropBefore, timeOf)
+		sh.mu.Unlock()
+		s.metrics.staleEntries.Add(dropped)
 	}
 }
@@ -1,13 +1,24 @@
 package tcpmeasurer
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
+	"maps"
+	"orchestrator/common/pkg/sketch"
 	"orchestrator/common/pkg/utils"
+	"slices"
+	"strings"
 	"time"
 
-	"bitbucket.org/Taal_Orchestrator/orca-std-go/entities"
 	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
-	"github.com/montanaflynn/stats"
+)
+
+const (
+	// quantiles of the latency are reported with 1% relative error, see sketch package.
+	// 2048 buckets cover any range of latencies from 1µs to hours without collapsing.
+	latencyRelativeAccuracy = 0.01
+	latencyMaxBuckets       = 2048
 )
 
 func WithDumpBufferInterval(interval time.Duration) Opt {
@@ -16,6 +27,52 @@ func WithDumpBufferInterval(interval time.Duration) Opt {
 	}
 }
 
+// WithLatencyUnit sets unit of the latency fields in window results, samples are kept as durations anyway
+func WithLatencyUnit(unit time.Duration) Opt {
+	return func(s *Service) {
+		if unit > 0 {
+			s.latencyUnit = unit
+		}
+	}
+}
+
+var latencyUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// ParseLatencyUnit converts unit name (ns, us, ms, s) to the value for WithLatencyUnit
+func ParseLatencyUnit(name string) (time.Duration, error) {
+	unit, ok := latencyUnits[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown latency unit: %s", name)
+	}
+	return unit, nil
+}
+
+// latencyUnitName is the inverse of ParseLatencyUnit, non-standard units are written as duration
+func latencyUnitName(unit time.Duration) string {
+	switch unit {
+	case time.Nanosecond:
+		return "ns"
+	case time.Microsecond:
+		return "us"
+	case time.Millisecond:
+		return "ms"
+	case time.Second:
+		return "s"
+	default:
+		return unit.String()
+	}
+}
+
+func newLatencySketch() *sketch.DDSketch {
+	return sketch.MustNew(latencyRelativeAccuracy, latencyMaxBuckets)
+}
+
 func (s *Service) DumpData() {
 	ticker := time.NewTicker(s.dumpBufferInterval)
 	defer ticker.Stop()
@@ -29,99 +86,308 @@ func (s *Service) DumpData() {
 	}
 }
 
+// DumpIt processes all windows closed by the watermark in chronological order.
+// Window is closed when the watermark passes its end plus allowed lateness.
 func (s *Service) DumpIt() {
 	s.l.Info("dumping data")
-	dumpBefore := utils.RoundToNearest5Minutes(utils.RemoveTimezone(time.Now()).Add(-6 * time.Minute))
-	var (
-		dumpData map[string][]float64
-		dumpKey  time.Time
-	)
-	s.mu.Lock()
-	for key := range s.buffer {
+	late := s.metrics.lateSamples.Load()
+	if reported := s.lateReported.Swap(late); late > reported {
+		s.l.Info("late samples dropped", slog.Uint64("count", late-reported), slog.Duration("allowed_lateness", s.allowedLateness))
+	}
+
+	watermark := s.eventWatermark()
+	windows := s.takeWindows(func(key time.Time) bool {
 		s.l.Info("checking key", slog.String("key", key.String()))
-		if key.Before(dumpBefore) {
-			dumpData = s.buffer[key]
-			delete(s.buffer, key)
-			dumpKey = key
-			break
-		}
+		return s.windowClosed(key, watermark)
+	})
+	if len(windows) == 0 {
+		s.l.Info("no data to dump", slog.String("watermark", watermark.String()))
 	}
-	s.mu.Unlock()
-	if len(dumpData) == 0 {
-		s.l.Info("no data to dump")
-		return
+
+	for _, w := range windows {
+		s.processData(w, false)
 	}
+	s.evictConnections(watermark)
+}
 
-	s.processData(dumpKey, dumpData)
+// flushAll processes all windows, including open ones
+func (s *Service) flushAll() {
+	for _, w := range s.takeWindows(func(time.Time) bool { return true }) {
+		s.processData(w, true)
+	}
 }
 
-func (s *Service) processData(dumpKey time.Time, dumpData map[string][]float64) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+type bufferedWindow struct {
+	key        time.Time
+	latency    map[connKey]*sketch.DDSketch
+	processing map[connKey]*sketch.DDSketch
+	handshake  map[connKey]*sketch.DDSketch
+	timestamps map[connKey]*sketch.DDSketch
+	shares     map[connKey]*shareCounts
+	events     map[connKey]*tcpEventCounts
+	notify     []*notifyJob
+	miners     map[connKey]string // targetHost -> worker group when the window is taken
+	minersCoin map[connKey]string // targetHost -> coin, empty if no coin rule matched
+}
 
-	minerCoin := make(map[string]string, len(s.matchedMiners))
-	aggregated := make(map[string][]float64, len(dumpData))
-	for targetHost := range dumpData {
-		minerData, _ := s.matchedMiners[targetHost]
-		if minerData == "" {
-			continue
+// takeWindows removes windows from buffers of all shards and returns them in chronological order,
+// samples of the address in different shards are merged
+func (s *Service) takeWindows(take func(key time.Time) bool) []bufferedWindow {
+	decided := make(map[time.Time]bool)
+	taken := func(key time.Time) bool {
+		if _, ok := decided[key]; !ok {
+			decided[key] = take(key)
 		}
-		minerCoin[minerData] = s.matchedMinersCoin[targetHost]
-		if _, ok := aggregated[minerData]; !ok {
-			aggregated[minerData] = make([]float64, 0, 1000)
-		}
-		aggregated[minerData] = append(aggregated[minerData], dumpData[targetHost]...)
-	}
-
-	for minerData := range aggregated {
-		miningCoin, _ := minerCoin[minerData]
-		l := s.l.With(
-			slog.String("observe_interval", dumpKey.Format(time.DateTime)),
-			logger.WithWorkerGroup(minerData),
-			slog.String("mining_coin", miningCoin),
-			slog.Int64("total_requests", int64(len(aggregated[minerData]))),
-		)
-		avg, err := stats.Mean(aggregated[minerData])
-		if err != nil {
-			l.Error("failed to calculate average", err)
-			continue
+		return decided[key]
+	}
+	s.lockShards()
+	defer s.unlockShards()
+	miners, minersCoin := make(map[connKey]string), make(map[connKey]string)
+	jobs := make(map[string]*notifyJob)
+	for _, sh := range s.shards {
+		maps.Copy(miners, sh.matchedMiners)
+		maps.Copy(minersCoin, sh.matchedMinersCoin)
+		for id, job := range sh.notifyJobs {
+			jobs[id] = mergeJob(jobs[id], job)
+		}
+	}
+	windows := make(map[time.Time]*bufferedWindow)
+	window := func(key time.Time) *bufferedWindow {
+		w, ok := windows[key]
+		if !ok {
+			w = &bufferedWindow{key: key, miners: miners, minersCoin: minersCoin}
+			windows[key] = w
+		}
+		return w
+	}
+	for _, job := range jobs {
+		if key := utils.RoundToNearest5Minutes(job.sentAt); taken(key) {
+			w := window(key)
+			w.notify = append(w.notify, job)
+			for _, sh := range s.shards {
+				delete(sh.notifyJobs, job.id)
+			}
+		}
+	}
+	for _, sh := range s.shards {
+		s.takeSketches(sh.buffer, taken, window, func(w *bufferedWindow) *map[connKey]*sketch.DDSketch { return &w.latency })
+		s.takeSketches(sh.processing, taken, window, func(w *bufferedWindow) *map[connKey]*sketch.DDSketch { return &w.processing })
+		s.takeSketches(sh.handshakeRTT, taken, window, func(w *bufferedWindow) *map[connKey]*sketch.DDSketch { return &w.handshake })
+		s.takeSketches(sh.tsRTT, taken, window, func(w *bufferedWindow) *map[connKey]*sketch.DDSketch { return &w.timestamps })
+		takeHosts(sh.shares, taken, window, func(w *bufferedWindow) *map[connKey]*shareCounts { return &w.shares }, (*shareCounts).merge)
+		takeHosts(sh.events, taken, window, func(w *bufferedWindow) *map[connKey]*tcpEventCounts { return &w.events }, (*tcpEventCounts).merge)
+	}
+	sorted := make([]bufferedWindow, 0, len(windows))
+	for _, w := range windows {
+		sorted = append(sorted, *w)
+	}
+	slices.SortFunc(sorted, func(a, b bufferedWindow) int {
+		return a.key.Compare(b.key)
+	})
+	return sorted
+}
+
+func (s *Service) takeSketches(buffer map[time.Time]map[connKey]*sketch.DDSketch, take func(key time.Time) bool,
+	window func(key time.Time) *bufferedWindow, field func(w *bufferedWindow) *map[connKey]*sketch.DDSketch) {
+	takeHosts(buffer, take, window, field, func(dst, src *sketch.DDSketch) {
+		if err := dst.Merge(src); err != nil {
+			s.l.Error("failed to merge latency", err)
 		}
+	})
+}
 
-		percent95, err := stats.Percentile(aggregated[minerData], 95)
-		if err != nil {
-			l.Error("failed to calculate 95 percentile", err)
+// takeHosts moves taken windows of the shard buffer into the field of the window, host data is merged if the address
+// is already there from another shard
+func takeHosts[T any](buffer map[time.Time]map[connKey]T, take func(key time.Time) bool,
+	window func(key time.Time) *bufferedWindow, field func(w *bufferedWindow) *map[connKey]T, merge func(dst, src T)) {
+	for key, hosts := range buffer {
+		if !take(key) {
 			continue
 		}
-		percent99, err := stats.Percentile(aggregated[minerData], 99)
-		if err != nil {
-			l.Error("failed to calculate 99 percentile", err)
+		delete(buffer, key)
+		dst := field(window(key))
+		if *dst == nil {
+			*dst = hosts
 			continue
 		}
+		for targetHost, data := range hosts {
+			if existing, ok := (*dst)[targetHost]; ok {
+				merge(existing, data)
+			} else {
+				(*dst)[targetHost] = data
+			}
+		}
+	}
+}
 
-		median, err := stats.Median(aggregated[minerData])
-		if err != nil {
-			l.Error("failed to calculate median", err)
-			continue
+// mergeJob joins deliveries of the job seen by different shards, the first notify of the job is kept
+func mergeJob(merged, job *notifyJob) *notifyJob {
+	if merged == nil {
+		return &notifyJob{id: job.id, sentAt: job.sentAt, deliveries: maps.Clone(job.deliveries)}
+	}
+	if job.sentAt.Before(merged.sentAt) {
+		merged.sentAt = job.sentAt
+	}
+	for targetHost, ackAt := range job.deliveries {
+		if _, ok := merged.deliveries[targetHost]; !ok {
+			merged.deliveries[targetHost] = ackAt
 		}
-		maxL, err := stats.Max(aggregated[minerData])
-		if err != nil {
-			l.Error("failed to calculate max", err)
-			continue
+	}
+	return merged
+}
+
+func (s *Service) processData(window bufferedWindow, partial bool) {
+	minerCoin := make(map[string]string, len(window.miners))
+	latencies := s.aggregateByWorkerGroup(window, window.latency, minerCoin)
+	processing := s.aggregateByWorkerGroup(window, window.processing, minerCoin)
+	handshakes := s.aggregateByWorkerGroup(window, window.handshake, minerCoin)
+	timestamps := s.aggregateByWorkerGroup(window, window.timestamps, minerCoin)
+	shares := make(map[string]*shareCounts, len(window.shares))
+	for targetHost, hostShares := range window.shares {
+		if minerData := s.workerGroupCoin(window, targetHost, minerCoin); minerData != "" {
+			if _, ok := shares[minerData]; !ok {
+				shares[minerData] = &shareCounts{}
+			}
+			shares[minerData].merge(hostShares)
+		}
+	}
+	events := make(map[string]*tcpEventCounts, len(window.events))
+	for targetHost, hostEvents := range window.events {
+		if minerData := s.workerGroupCoin(window, targetHost, minerCoin); minerData != "" {
+			if _, ok := events[minerData]; !ok {
+				events[minerData] = &tcpEventCounts{}
+			}
+			events[minerData].merge(hostEvents)
+		}
+	}
+	notify := s.aggregateNotify(window, minerCoin)
+
+	unit := float64(s.latencyUnit)
+	results := make([]WindowResult, 0, len(minerCoin))
+	for minerData, miningCoin := range minerCoin {
+		result := WindowResult{
+			WorkerGroup: minerData,
+			Coin:        miningCoin,
+			Interval:    window.key,
+			Partial:     partial,
+			Unit:        latencyUnitName(s.latencyUnit),
+		}
+		if latency, ok := latencies[minerData]; ok {
+			s.metrics.observeWindow(minerData, miningCoin, latency)
+			result.Count = latency.Count()
+			result.Mean = latency.Mean() / unit
+			result.Median = latency.Quantile(0.5) / unit
+			result.P95 = latency.Quantile(0.95) / unit
+			result.P99 = latency.Quantile(0.99) / unit
+			result.Min = latency.Min() / unit
+			result.Max = latency.Max() / unit
+		}
+		if rtt, ok := timestamps[minerData]; ok {
+			s.metrics.observeTimestampRTT(minerData, miningCoin, rtt)
+			result.TimestampCount = rtt.Count()
+			result.TimestampMean = rtt.Mean() / unit
+			result.TimestampMedian = rtt.Quantile(0.5) / unit
+			result.TimestampP95 = rtt.Quantile(0.95) / unit
+			result.TimestampP99 = rtt.Quantile(0.99) / unit
+			result.TimestampMin = rtt.Min() / unit
+			result.TimestampMax = rtt.Max() / unit
+		}
+		if submits, ok := processing[minerData]; ok {
+			s.metrics.observeProcessing(minerData, miningCoin, submits)
+			result.ProcessingCount = submits.Count()
+			result.ProcessingMean = submits.Mean() / unit
+			result.ProcessingMedian = submits.Quantile(0.5) / unit
+			result.ProcessingP95 = submits.Quantile(0.95) / unit
+			result.ProcessingP99 = submits.Quantile(0.99) / unit
+			result.ProcessingMax = submits.Max() / unit
+		}
+		if rtt, ok := handshakes[minerData]; ok {
+			s.metrics.observeHandshake(minerData, miningCoin, rtt)
+			result.HandshakeCount = rtt.Count()
+			result.HandshakeMedian = rtt.Quantile(0.5) / unit
+			result.HandshakeMin = rtt.Min() / unit
+			result.HandshakeMax = rtt.Max() / unit
 		}
-		minL, err := stats.Min(aggregated[minerData])
-		if err != nil {
-			l.Error("failed to calculate min", err)
+		if counts, ok := shares[minerData]; ok {
+			s.metrics.observeShares(minerData, miningCoin, counts)
+			result.SharesAccepted = counts[shareAccepted]
+			result.SharesStale = counts[shareStale]
+			result.SharesRejected, result.RejectReasons = counts.rejected()
+		}
+		if counts, ok := events[minerData]; ok {
+			s.metrics.observeTCPEvents(minerData, miningCoin, counts)
+			result.Segments = counts[tcpEventSegment]
+			result.Retransmits = counts[tcpEventRetransmit]
+			result.RetransmitRate = counts.rate(tcpEventRetransmit, tcpEventSegment)
+			result.MinerACKs = counts[tcpEventACK]
+			result.DupACKs = counts[tcpEventDupACK]
+			result.DupACKRate = counts.rate(tcpEventDupACK, tcpEventACK)
+			result.Resets = counts[tcpEventReset]
+			result.FINs = counts[tcpEventFIN]
+			result.ConnectionsOpened = counts[tcpEventOpen]
+			result.ConnectionsClosed = counts[tcpEventClose]
+			result.Reconnects = counts[tcpEventReconnect]
+		}
+		if stats, ok := notify[minerData]; ok {
+			s.metrics.observeNotify(minerData, miningCoin, stats)
+			result.NotifyJobs = stats.jobs
+			result.NotifyDeliveryMedian = stats.delivery.Quantile(0.5) / unit
+			result.NotifyDeliveryP95 = stats.delivery.Quantile(0.95) / unit
+			result.NotifyDeliveryMax = stats.delivery.Max() / unit
+			result.NotifySpreadMedian = stats.spread.Quantile(0.5) / unit
+			result.NotifySpreadP95 = stats.spread.Quantile(0.95) / unit
+			result.NotifySpreadMax = stats.spread.Max() / unit
+		}
+		results = append(results, result)
+	}
+	slices.SortFunc(results, func(a, b WindowResult) int {
+		return strings.Compare(a.WorkerGroup, b.WorkerGroup)
+	})
+	s.writeResults(results)
+}
+
+// aggregateByWorkerGroup merges sketches of miner hosts into worker group ones, hosts which are not mapped are skipped.
+// Coin of every worker group is saved to minerCoin.
+func (s *Service) aggregateByWorkerGroup(window bufferedWindow, data map[connKey]*sketch.DDSketch, minerCoin map[string]string) map[string]*sketch.DDSketch {
+	aggregated := make(map[string]*sketch.DDSketch, len(data))
+	for targetHost, hostData := range data {
+		minerData := s.workerGroupCoin(window, targetHost, minerCoin)
+		if minerData == "" {
 			continue
 		}
-		l.With(
-			slog.Float64("avg_latency", avg),
-			slog.Float64("95_percentile", percent95),
-			slog.Float64("99_percentile", percent99),
-			slog.Float64("median_latency", median),
-			slog.Float64("max_latency", maxL),
-			slog.Float64("min_latency", minL),
-			logger.WithLatencyFlag(),
-			logger.WithNetworkConnectionType(entities.MinerExchangeDataWithStratum),
-		).Info("miner latency")
+		if _, ok := aggregated[minerData]; !ok {
+			aggregated[minerData] = newLatencySketch()
+		}
+		if err := aggregated[minerData].Merge(hostData); err != nil {
+			s.l.Error("failed to merge latency", err, logger.WithWorkerGroup(minerData))
+		}
+	}
+	return aggregated
+}
+
+// workerGroupCoin returns worker group of the miner host in the window and saves its coin to minerCoin
+func (s *Service) workerGroupCoin(window bufferedWindow, targetHost connKey, minerCoin map[string]string) string {
+	minerData := window.miners[targetHost]
+	if minerData == "" {
+		return ""
+	}
+	if coin := window.minersCoin[targetHost]; coin != "" {
+		minerCoin[minerData] = coin
+	} else if _, ok := minerCoin[minerData]; !ok {
+		minerCoin[minerData] = s.defaultCoin
+	}
+	return minerData
+}
+
+// writeResults passes results to every sink, failure of one sink does not affect others
+func (s *Service) writeResults(results []WindowResult) {
+	if len(results) == 0 {
+		return
+	}
+	ctx := context.WithoutCancel(s.ctx) // results are written during shutdown as well
+	for _, sink := range s.sinks {
+		if err := sink.Write(ctx, results); err != nil {
+			s.l.Error("failed to write results", err, slog.String("sink", fmt.Sprintf("%T", sink)))
+		}
 	}
 }
@@ -1,6 +1,7 @@
 package tcpmeasurer_test
 
 import (
+	tcpmeasurer "orchestrator/common/pkg/tcp_measurer"
 	"orchestrator/common/pkg/utils"
 	"testing"
 	"time"
@@ -26,3 +27,20 @@ func TestDump(t *testing.T) {
 	}
 	require.Equal(t, "a", dumpData)
 }
+
+func TestParseLatencyUnit(t *testing.T) {
+	table := map[string]time.Duration{
+		"ns": time.Nanosecond,
+		"us": time.Microsecond,
+		"µs": time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+	}
+	for name, unit := range table {
+		parsed, err := tcpmeasurer.ParseLatencyUnit(name)
+		require.NoError(t, err)
+		require.Equal(t, unit, parsed)
+	}
+	_, err := tcpmeasurer.ParseLatencyUnit("min")
+	require.Error(t, err)
+}
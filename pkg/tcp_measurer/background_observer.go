@@ -34,10 +34,39 @@ func (s *Service) parsePCAPFiles() {
 }
 
 func (s *Service) checkFiles() {
-	dir, err := os.ReadDir(s.filesPath)
+	fileNames, err := s.captureFiles()
 	if err != nil {
 		s.l.Fatal("failed to read dir", err, slog.String("path", s.filesPath))
 	}
+	if len(fileNames) < 2 {
+		return
+	}
+	s.parseFile(fileNames[0]) // process only first file, last one is being written by tcpdump
+}
+
+// drainFiles parses all files which are left after capture is stopped.
+// If tcpdump is run outside of the service or it is not known to have exited, it may still write the last file,
+// so it is kept for the next start.
+func (s *Service) drainFiles() {
+	fileNames, err := s.captureFiles()
+	if err != nil {
+		s.l.Error("failed to read dir", err, slog.String("path", s.filesPath))
+		return
+	}
+	if (s.skipCMD || !s.captureStopped.Load()) && len(fileNames) > 0 {
+		fileNames = fileNames[:len(fileNames)-1]
+	}
+	for _, fileName := range fileNames {
+		s.parseFile(fileName)
+	}
+}
+
+// captureFiles returns tcpdump files sorted by creation time, it is encoded in the name
+func (s *Service) captureFiles() ([]string, error) {
+	dir, err := os.ReadDir(s.filesPath)
+	if err != nil {
+		return nil, err
+	}
 	fileNames := make([]string, 0, len(dir))
 	for i := range dir {
 		if dir[i].IsDir() {
@@ -45,24 +74,27 @@ func (s *Service) checkFiles() {
 		}
 		if dir[i].Type().IsRegular() {
 			fileName := dir[i].Name()
-			validFile := strings.HasSuffix(fileName, ".pcap") && strings.HasPrefix(fileName, "caapture")
+			validFile := (strings.HasSuffix(fileName, ".pcap") || strings.HasSuffix(fileName, ".pcapng")) && strings.HasPrefix(fileName, "caapture")
 			if validFile {
 				fileNames = append(fileNames, fileName)
 			}
 
 		}
 	}
-	if len(fileNames) < 2 {
-		return
-	}
 	slices.Sort(fileNames)
-	fullPath := s.filesPath + "/" + fileNames[0]
-	if err = s.ReadFilePureGO(fullPath); err != nil { // process only first file
-		// s.l.Error("failed to read file", err, slog.String("file", fileNames[0]))
+	return fileNames, nil
+}
+
+func (s *Service) parseFile(fileName string) {
+	fullPath := s.filesPath + "/" + fileName
+	if err := s.ReadFilePureGO(fullPath); err != nil {
+		s.metrics.parseErrors.Add(1)
+		// s.l.Error("failed to read file", err, slog.String("file", fileName))
 	} else {
-		// s.l.Info("file processed", slog.String("file", fileNames[0]))
+		s.metrics.filesParsed.Add(1)
+		// s.l.Info("file processed", slog.String("file", fileName))
 	}
-	if err = os.Remove(fullPath); err != nil {
-		s.l.Fatal("failed to remove file", err, slog.String("file", fileNames[0]))
+	if err := os.Remove(fullPath); err != nil {
+		s.l.Fatal("failed to remove file", err, slog.String("file", fileName))
 	}
 }
@@ -0,0 +1,229 @@
+package tcpmeasurer
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// values from linux/if_packet.h, they are not exported by syscall package
+const (
+	solPacket      = 263
+	packetRxRing   = 5
+	packetVersion  = 10
+	tpacketV3      = 2
+	tpStatusKernel = 0
+	tpStatusUser   = 1
+	pollIn         = 0x1
+	pollErr        = 0x8
+	tpacketHdrLen  = 48  // TPACKET_ALIGN(sizeof(struct tpacket3_hdr)), struct sockaddr_ll follows the header
+	packetOutgoing = 4   // sll_pkttype of the frame sent by the host
+	arphrdLoopback = 772 // sll_hatype of the loopback interface
+
+	captureBlockSize    = 1 << 20
+	captureBlockNr      = 16
+	captureFrameSize    = 1 << 11
+	captureBlockTimeout = 100 // ms, kernel hands over not filled block to user space after this timeout
+	capturePollTimeout  = 250 * time.Millisecond
+)
+
+// tpacketReq3 is struct tpacket_req3
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+// pollFd is struct pollfd
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// Capturer reads packets from AF_PACKET socket with TPACKET_V3 ring, so there is no need in tcpdump and rotated files.
+// Socket is opened in cooked mode (SOCK_DGRAM), every frame starts with network header regardless of the interface type.
+// Kernel applies BPF filter equal to `tcp port N and (tcp[tcpflags] & (tcp-syn|tcp-ack|tcp-rst) != 0)` before frames land in the ring.
+type Capturer struct {
+	fd   int
+	ring []byte
+}
+
+// NewCapturer opens socket on the interface, `any` means all interfaces
+func NewCapturer(iface string, port uint64, snapLen int) (*Capturer, error) {
+	// protocol 0 means socket does not receive anything until bind, so no frames bypass the filter
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	c := &Capturer{fd: fd}
+	if err = c.setup(iface, port, snapLen); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Capturer) setup(iface string, port uint64, snapLen int) error {
+	ifIndex := 0
+	if iface != "any" {
+		netIface, err := net.InterfaceByName(iface)
+		if err != nil {
+			return fmt.Errorf("failed to find interface %s: %w", iface, err)
+		}
+		ifIndex = netIface.Index
+	}
+
+	if err := syscall.SetsockoptInt(c.fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return fmt.Errorf("failed to set TPACKET_V3: %w", err)
+	}
+
+	filter := captureFilter(uint16(port), snapLen)
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := setsockopt(c.fd, syscall.SOL_SOCKET, syscall.SO_ATTACH_FILTER, unsafe.Pointer(&prog), unsafe.Sizeof(prog)); err != nil {
+		return fmt.Errorf("failed to attach filter: %w", err)
+	}
+
+	req := tpacketReq3{
+		blockSize:    captureBlockSize,
+		blockNr:      captureBlockNr,
+		frameSize:    captureFrameSize,
+		frameNr:      captureBlockSize / captureFrameSize * captureBlockNr,
+		retireBlkTov: captureBlockTimeout,
+	}
+	if err := setsockopt(c.fd, solPacket, packetRxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return fmt.Errorf("failed to setup rx ring: %w", err)
+	}
+
+	ring, err := syscall.Mmap(c.fd, 0, captureBlockSize*captureBlockNr, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to mmap rx ring: %w", err)
+	}
+	c.ring = ring
+
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifIndex}
+	if err = syscall.Bind(c.fd, addr); err != nil {
+		return fmt.Errorf("failed to bind packet socket: %w", err)
+	}
+	return nil
+}
+
+// Run passes every captured frame to handler until context is canceled.
+// Frame points to the ring memory and is valid only during the handler call.
+func (c *Capturer) Run(ctx context.Context, handler func(eventTime time.Time, frame []byte)) error {
+	block := 0
+	for ctx.Err() == nil {
+		desc := c.ring[block*captureBlockSize : (block+1)*captureBlockSize]
+		status := (*uint32)(unsafe.Pointer(&desc[8])) // tpacket_block_desc.hdr.bh1.block_status
+		if atomic.LoadUint32(status)&tpStatusUser == 0 {
+			if err := c.poll(capturePollTimeout); err != nil {
+				return err
+			}
+			continue
+		}
+		walkBlock(desc, handler)
+		atomic.StoreUint32(status, tpStatusKernel)
+		block = (block + 1) % captureBlockNr
+	}
+	return nil
+}
+
+// walkBlock iterates over tpacket3_hdr entries of the retired block
+func walkBlock(desc []byte, handler func(eventTime time.Time, frame []byte)) {
+	numPkts := binary.NativeEndian.Uint32(desc[12:16])
+	offset := binary.NativeEndian.Uint32(desc[16:20])
+	for i := uint32(0); i < numPkts; i++ {
+		hdr := desc[offset:]
+		tsSec := binary.NativeEndian.Uint32(hdr[4:8])
+		tsNSec := binary.NativeEndian.Uint32(hdr[8:12])
+		capLen := binary.NativeEndian.Uint32(hdr[12:16])
+		macOffset := uint32(binary.NativeEndian.Uint16(hdr[24:26]))
+		// loopback frames are seen twice, as sent and as received, sent copy is skipped same as libpcap does,
+		// otherwise every segment is processed twice
+		hatype, pkttype := binary.NativeEndian.Uint16(hdr[tpacketHdrLen+8:tpacketHdrLen+10]), hdr[tpacketHdrLen+10]
+		if hatype != arphrdLoopback || pkttype != packetOutgoing {
+			handler(time.Unix(int64(tsSec), int64(tsNSec)), hdr[macOffset:macOffset+capLen])
+		}
+		offset += binary.NativeEndian.Uint32(hdr[0:4])
+	}
+}
+
+func (c *Capturer) poll(timeout time.Duration) error {
+	pfd := pollFd{fd: int32(c.fd), events: pollIn | pollErr}
+	ts := syscall.NsecToTimespec(int64(timeout))
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(&ts)), 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return fmt.Errorf("failed to poll packet socket: %w", errno)
+	}
+	return nil
+}
+
+func (c *Capturer) Close() error {
+	if c.ring != nil {
+		if err := syscall.Munmap(c.ring); err != nil {
+			return fmt.Errorf("failed to unmap rx ring: %w", err)
+		}
+		c.ring = nil
+	}
+	return syscall.Close(c.fd)
+}
+
+// captureFilter is compiled `tcp port N and (tcp[tcpflags] & (tcp-syn|tcp-ack|tcp-rst) != 0)` for frames starting with ip header.
+// Same as tcpdump it checks IPv6 packets only when tcp header follows the fixed header, extension headers are skipped by decoder.
+func captureFilter(port uint16, snapLen int) []syscall.SockFilter {
+	const (
+		ipv6   = 14
+		accept = 23
+		drop   = 24
+	)
+	return []syscall.SockFilter{
+		{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 0},                                      // 0: ldb [0]
+		{Code: syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K, K: 0xf0},                                  // 1: and #0xf0
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: 0x40, Jf: ipv6 - 3},                    // 2: ipv4
+		{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 9},                                      // 3: ldb [9]
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: syscall.IPPROTO_TCP, Jf: drop - 5},     // 4: tcp
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 6},                                      // 5: ldh [6]
+		{Code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, K: 0x1fff, Jt: drop - 7},                 // 6: skip fragments
+		{Code: syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH, K: 0},                                     // 7: x = ip header length
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND, K: 0},                                      // 8: source port
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: uint32(port), Jt: 2},                   // 9
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_IND, K: 2},                                      // 10: destination port
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: uint32(port), Jf: drop - 12},           // 11
+		{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_IND, K: 13},                                     // 12: tcp flags
+		{Code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, K: 0x16, Jt: accept - 14, Jf: drop - 14}, // 13: syn|ack|rst
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: 0x60, Jf: drop - 15},                   // 14: ipv6
+		{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 6},                                      // 15: next header
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: syscall.IPPROTO_TCP, Jf: drop - 17},    // 16: tcp
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 40},                                     // 17: source port
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: uint32(port), Jt: 2},                   // 18
+		{Code: syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS, K: 42},                                     // 19: destination port
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, K: uint32(port), Jf: drop - 21},           // 20
+		{Code: syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS, K: 53},                                     // 21: tcp flags
+		{Code: syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K, K: 0x16, Jf: drop - 23},                  // 22: syn|ack|rst
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: uint32(snapLen)},                                         // 23: accept
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: 0},                                                       // 24: drop
+	}
+}
+
+func setsockopt(fd, level, name int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(name), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,174 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/require"
+)
+
+// run as root or inside network namespace: `unshare -rn go test -run Capturer ./pkg/tcp_measurer/`
+func newTestCapturer(t *testing.T, iface string, port int) *Capturer {
+	capturer, err := NewCapturer(iface, uint64(port), 145)
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		t.Skip("CAP_NET_RAW is required to open packet socket")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, capturer.Close()) })
+	return capturer
+}
+
+// spawnStratum accepts connections and answers every line with stratum response
+func spawnStratum(t *testing.T, network, addr string) net.Listener {
+	listener, err := net.Listen(network, addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, errA := listener.Accept()
+			if errA != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					if _, errR := reader.ReadString('\n'); errR != nil {
+						return
+					}
+					if _, errW := conn.Write([]byte(`{"id":1,"result":true,"error":null}` + "\n")); errW != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// submitShares sends mining.submit requests and waits for every response, so miner sends pure ACK for each of them
+func submitShares(t *testing.T, network, addr, worker string, count int) net.Addr {
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for i := 0; i < count; i++ {
+		_, err = fmt.Fprintf(conn, `{"params": ["%s", "BSV-846861-89d48", "00000000", "665a2ed9", "9e0a1a2b"], "id": %d, "method": "mining.submit"}`+"\n", worker, i+1)
+		require.NoError(t, err)
+		_, err = reader.ReadString('\n')
+		require.NoError(t, err)
+		time.Sleep(100 * time.Millisecond) // let the delayed ACK go
+	}
+	return conn.LocalAddr()
+}
+
+func TestCapturer_Run(t *testing.T) {
+	// given
+	port, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	otherPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	capturer := newTestCapturer(t, "lo", port)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		frames [][]byte
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- capturer.Run(ctx, func(_ time.Time, frame []byte) {
+			mu.Lock()
+			frames = append(frames, append([]byte(nil), frame...))
+			mu.Unlock()
+		})
+	}()
+	spawnStratum(t, "tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	spawnStratum(t, "tcp4", fmt.Sprintf("127.0.0.1:%d", otherPort))
+
+	// when
+	submitShares(t, "tcp4", fmt.Sprintf("127.0.0.1:%d", port), "wg1.worker", 2)
+	submitShares(t, "tcp4", fmt.Sprintf("127.0.0.1:%d", otherPort), "wg1.worker", 2)
+
+	// then
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(frames) >= 8 // handshake, 2 requests, 2 responses and ACKs
+	}, 3*time.Second, 50*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, frame := range frames {
+		require.Equal(t, byte(0x40), frame[0]&0xf0, "frame should start with IPv4 header")
+		ihl := int(frame[0]&0x0f) * 4
+		srcPort := int(frame[ihl])<<8 | int(frame[ihl+1])
+		dstPort := int(frame[ihl+2])<<8 | int(frame[ihl+3])
+		require.True(t, srcPort == port || dstPort == port, "frame from other port passed the filter")
+	}
+}
+
+func TestService_RunCapturer(t *testing.T) {
+	table := map[string]string{
+		"tcp4": "127.0.0.1",
+		"tcp6": "::1",
+	}
+	for network, host := range table {
+		t.Run(network, func(t *testing.T) {
+			// given
+			port, err := freeport.GetFreePort()
+			require.NoError(t, err)
+			newTestCapturer(t, "lo", port) // skip if capture is not permitted
+			appLogger, err := logger.NewAppSLogger(&logger.Config{Progname: "orca_mapicron"}, "")
+			require.NoError(t, err)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			srv := NewService(ctx, appLogger, uint64(port), WithCaptureMode(CaptureModeAFPacket), WithObserveInterface("lo"), WithShards(1))
+			require.NoError(t, srv.Init())
+			done := make(chan error, 1)
+			go func() {
+				done <- srv.RunCapturer()
+			}()
+			time.Sleep(300 * time.Millisecond) // socket is bound
+			addr := net.JoinHostPort(host, strconv.Itoa(port))
+			spawnStratum(t, network, addr)
+
+			// when
+			minerAddr := submitShares(t, network, addr, "lp-wg4-s19jpro.cos-pb12-r7b1-96", 5)
+			miner := connKey{miner: netip.MustParseAddrPort(minerAddr.String()), stratum: netip.MustParseAddrPort(addr)}
+
+			// then
+			require.Eventually(t, func() bool {
+				srv.shards[0].mu.Lock()
+				defer srv.shards[0].mu.Unlock()
+				samples := uint64(0)
+				for window := range srv.shards[0].buffer {
+					if latency, ok := srv.shards[0].buffer[window][miner]; ok {
+						samples += latency.Count()
+					}
+				}
+				return samples > 0
+			}, 3*time.Second, 50*time.Millisecond)
+			srv.shards[0].mu.Lock()
+			require.Equal(t, "lp-wg4-s19jpro.cos-pb12-r7b1-96", srv.shards[0].matchedMiners[miner])
+			require.Equal(t, "BSV", srv.shards[0].matchedMinersCoin[miner])
+			srv.shards[0].mu.Unlock()
+			cancel()
+			require.NoError(t, <-done)
+		})
+	}
+}
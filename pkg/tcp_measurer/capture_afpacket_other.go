@@ -0,0 +1,24 @@
+//go:build !linux
+
+package tcpmeasurer
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Capturer is available only on linux, use tcpdump capture mode on other platforms
+type Capturer struct{}
+
+func NewCapturer(_ string, _ uint64, _ int) (*Capturer, error) {
+	return nil, errors.New("afpacket capture is supported only on linux")
+}
+
+func (c *Capturer) Run(_ context.Context, _ func(eventTime time.Time, frame []byte)) error {
+	return errors.New("afpacket capture is supported only on linux")
+}
+
+func (c *Capturer) Close() error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package tcpmeasurer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureStart is the time of the first packet of captures built by tests, it is in the 13:40 window
+var captureStart = time.Date(2024, 5, 31, 13, 43, 44, 0, time.UTC)
+
+// response is stratum response to the miner, the miner acknowledges it with ack = seq + len(testPayload)
+func response(miner netip.AddrPort, seq uint32) testSegment {
+	return testSegment{src: testStratum, dst: miner, seq: seq, ack: 100, flags: tcpFlagACK | tcpFlagPSH, window: 502, payload: testPayload}
+}
+
+// request is stratum message of the miner, e.g. mining.authorize or mining.submit
+func request(miner netip.AddrPort, seq, ack uint32, payload string) testSegment {
+	return testSegment{src: miner, dst: testStratum, seq: seq, ack: ack, flags: tcpFlagACK | tcpFlagPSH, window: 502, payload: []byte(payload)}
+}
+
+// reply is stratum message to the miner, e.g. response or mining.notify
+func reply(miner netip.AddrPort, seq, ack uint32, payload string) testSegment {
+	return testSegment{src: testStratum, dst: miner, seq: seq, ack: ack, flags: tcpFlagACK | tcpFlagPSH, window: 502, payload: []byte(payload)}
+}
+
+// capture collects segments, replay writes them into pcap file and reads it by the service the same way as files of
+// tcpdump
+type capture struct {
+	t      *testing.T
+	frames frameSource
+}
+
+func newCapture(t *testing.T) *capture {
+	return &capture{t: t}
+}
+
+func (c *capture) send(at time.Time, seg testSegment) {
+	c.frames = append(c.frames, testFrame{at: at, frame: buildSLL(seg.ip())})
+}
+
+// replay reads segments sent since the previous replay
+func (c *capture) replay(srv *Service) {
+	if len(c.frames) == 0 {
+		return
+	}
+	require.NoError(c.t, srv.ReadFilePureGO(writeCapture(c.t, c.frames)))
+	c.frames = nil
+}
+
+// sample sends stratum segment of the connection and ACK of the miner after the latency
+func (c *capture) sample(miner netip.AddrPort, seq uint32, ackAt time.Time, latency time.Duration) {
+	c.send(ackAt.Add(-latency), response(miner, seq))
+	c.send(ackAt, testSegment{src: miner, dst: testStratum, seq: 100, ack: seq + uint32(len(testPayload)), flags: tcpFlagACK, window: 502})
+}
+
+// connect opens connection of the miner by SYN with sequence isn
+func (c *capture) connect(miner netip.AddrPort, at time.Time, isn uint32) {
+	c.send(at, testSegment{src: miner, dst: testStratum, seq: isn, flags: tcpFlagSYN})
+}
+
+// authorize sends mining.authorize of the worker, it acknowledges stratum data before ack
+func (c *capture) authorize(miner netip.AddrPort, at time.Time, ack uint32, worker string) {
+	c.send(at, request(miner, 100, ack, fmt.Sprintf(`{"id":1,"method":"mining.authorize","params":["%s","x"]}`+"\n", worker)))
+}
+
+// metricsText returns metrics of the service in prometheus text format
+func metricsText(t *testing.T, srv *Service) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
+
+// resultOf returns the only result of the worker group written to the sink
+func resultOf(t *testing.T, sink *recordingSink, workerGroup string) WindowResult {
+	t.Helper()
+	var found []WindowResult
+	for _, r := range sink.written() {
+		if r.WorkerGroup == workerGroup {
+			found = append(found, r)
+		}
+	}
+	require.Len(t, found, 1, workerGroup)
+	return found[0]
+}
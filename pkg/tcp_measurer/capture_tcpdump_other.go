@@ -0,0 +1,10 @@
+//go:build !unix
+
+package tcpmeasurer
+
+import "os/exec"
+
+// setProcessGroup keeps default cancel of the command, tcpdump may outlive the shell, see drainFiles
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = tcpdumpStopTimeout
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package tcpmeasurer
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup runs the command in its own process group, cancel sends SIGTERM to the whole group,
+// so sudo and tcpdump started by the shell are stopped and flush the capture file, not only the shell
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = tcpdumpStopTimeout
+}
@@ -0,0 +1,111 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// unknownCoin is reported when no rule matches and default coin is not configured
+const unknownCoin = "unknown"
+
+// CoinRule maps miner connection to the coin label, all conditions which are set should match.
+// Rules are checked in order, the first matching one wins.
+type CoinRule struct {
+	Coin      string `json:"coin"`
+	JobPrefix string `json:"job_prefix,omitempty"` // prefix of the job id of mining.submit, e.g. "BSV-"
+	Port      uint16 `json:"port,omitempty"`       // stratum listening port
+	Worker    string `json:"worker,omitempty"`     // worker name pattern, see path.Match, e.g. "lp-wg*"
+}
+
+// defaultCoinRules are checked after configured ones, pools which put coin into the job id are detected without config
+var defaultCoinRules = []CoinRule{
+	{Coin: "BSV", JobPrefix: "BSV-"},
+	{Coin: "BCH", JobPrefix: "BCH-"},
+}
+
+// WithCoinRules sets rules which are checked before default job id prefixes
+func WithCoinRules(rules ...CoinRule) Opt {
+	return func(s *Service) {
+		s.coinRules = append(append(make([]CoinRule, 0, len(rules)+len(defaultCoinRules)), rules...), defaultCoinRules...)
+	}
+}
+
+// WithDefaultCoin sets coin of miners which are not matched by any rule
+func WithDefaultCoin(coin string) Opt {
+	return func(s *Service) {
+		if coin != "" {
+			s.defaultCoin = coin
+		}
+	}
+}
+
+// LoadCoinRules reads json array of rules from the file
+func LoadCoinRules(fileName string) ([]CoinRule, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read coin rules: %w", err)
+	}
+	return ParseCoinRules(data)
+}
+
+// ParseCoinRules decodes json array of rules and validates them
+func ParseCoinRules(data []byte) ([]CoinRule, error) {
+	var rules []CoinRule
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("failed to decode coin rules: %w", err)
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("invalid coin rule %d: %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *CoinRule) validate() error {
+	if r.Coin == "" {
+		return errors.New("coin is empty")
+	}
+	if r.JobPrefix == "" && r.Port == 0 && r.Worker == "" {
+		return errors.New("rule has no conditions")
+	}
+	if r.Worker != "" {
+		if _, err := path.Match(r.Worker, ""); err != nil {
+			return fmt.Errorf("bad worker pattern %q: %w", r.Worker, err)
+		}
+	}
+	return nil
+}
+
+// match checks the rule, job id is empty if it is not known, e.g. for mining.authorize
+func (r *CoinRule) match(worker, jobID []byte, port uint16) bool {
+	if r.JobPrefix != "" && !bytes.HasPrefix(jobID, []byte(r.JobPrefix)) {
+		return false
+	}
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+	if r.Worker != "" {
+		if ok, _ := path.Match(r.Worker, string(worker)); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// classifyCoin returns coin of the first matching rule or empty string, default coin is applied to the output only,
+// so connection which is mapped by mining.authorize gets coin from the job id of the first share
+func classifyCoin(rules []CoinRule, worker, jobID []byte, port uint16) string {
+	for i := range rules {
+		if rules[i].match(worker, jobID, port) {
+			return rules[i].Coin
+		}
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package tcpmeasurer
+
+import (
+	"orchestrator/common/pkg/sketch"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCoinRules(t *testing.T) {
+	rules, err := ParseCoinRules([]byte(`[
+		{"coin": "LTC", "port": 3334},
+		{"coin": "DOGE", "worker": "dg-*", "job_prefix": "D"},
+		{"coin": "BTC", "job_prefix": "btc:"}
+	]`))
+	require.NoError(t, err)
+	require.Equal(t, []CoinRule{
+		{Coin: "LTC", Port: 3334},
+		{Coin: "DOGE", Worker: "dg-*", JobPrefix: "D"},
+		{Coin: "BTC", JobPrefix: "btc:"},
+	}, rules)
+
+	for data, errText := range map[string]string{
+		`[{"port": 3334}]`: "invalid coin rule 0: coin is empty",
+		`[{"coin": "BTC", "port": 1}, {"coin": "LTC"}]`: "invalid coin rule 1: rule has no conditions",
+		`[{"coin": "LTC", "worker": "[a-"}]`:            "invalid coin rule 0: bad worker pattern",
+		`[{"coin": "LTC", "ports": [3334]}]`:            "failed to decode coin rules",
+		`{"coin": "LTC"}`:                               "failed to decode coin rules",
+	} {
+		_, err = ParseCoinRules([]byte(data))
+		require.ErrorContains(t, err, errText, data)
+	}
+
+	_, err = LoadCoinRules(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestClassifyCoin(t *testing.T) {
+	srv := newTestService(t, WithCoinRules(
+		CoinRule{Coin: "LTC", Port: 3334},
+		CoinRule{Coin: "DOGE", Worker: "dg-*", JobPrefix: "BCH-"},
+		CoinRule{Coin: "BTC", Worker: "btc-wg?.*"},
+		CoinRule{Coin: "XEC", JobPrefix: "XEC-"},
+	))
+	table := map[string]struct {
+		worker string
+		jobID  string
+		port   uint16
+		coin   string
+	}{
+		"port":                        {worker: "lp-wg4", jobID: "BSV-1", port: 3334, coin: "LTC"},
+		"all conditions should match": {worker: "dg-1", jobID: "BCH-1", port: 3333, coin: "DOGE"},
+		"default rule after":          {worker: "lp-wg4", jobID: "BCH-1", port: 3333, coin: "BCH"},
+		"worker pattern":              {worker: "btc-wg1.rig", port: 3333, coin: "BTC"},
+		"worker pattern mismatch":     {worker: "btc-wg10.rig", port: 3333},
+		"job prefix":                  {worker: "lp-wg4", jobID: "XEC-846861-8", port: 3333, coin: "XEC"},
+		"default job prefix":          {worker: "lp-wg4", jobID: "BSV-846861-8", port: 3333, coin: "BSV"},
+		"no job id":                   {worker: "lp-wg4", port: 3333},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.coin, classifyCoin(srv.coinRules, []byte(tc.worker), []byte(tc.jobID), tc.port))
+		})
+	}
+	require.Len(t, defaultCoinRules, 2, "option should not modify default rules")
+}
+
+func TestService_ProcessData_DefaultCoin(t *testing.T) {
+	recording := &recordingSink{}
+	srv := newTestService(t, WithSinks(recording), WithDefaultCoin(""))
+	require.Equal(t, unknownCoin, srv.defaultCoin, "empty default coin is ignored")
+	srv = newTestService(t, WithSinks(recording), WithDefaultCoin("BSV"))
+	host1, host2, host3 := connKey{miner: testMiner, stratum: testStratum}, connKey{miner: testMiner6, stratum: testStratum6}, connKey{miner: testMiner, stratum: testStratum, retired: 1}
+	miners := map[connKey]string{host1: "wg1", host2: "wg1", host3: "wg2"}
+	minersCoin := map[connKey]string{host1: "", host2: "BCH", host3: ""}
+	window := map[connKey]*sketch.DDSketch{}
+	for host := range miners {
+		window[host] = newLatencySketch()
+		window[host].Add(float64(time.Millisecond))
+	}
+
+	srv.processData(bufferedWindow{key: time.Date(2024, 5, 31, 13, 40, 0, 0, time.UTC), latency: window, miners: miners, minersCoin: minersCoin}, false)
+
+	require.Len(t, recording.results, 1)
+	require.Len(t, recording.results[0], 2)
+	require.Equal(t, "wg1", recording.results[0][0].WorkerGroup)
+	require.Equal(t, "BCH", recording.results[0][0].Coin, "matched coin wins over default one")
+	require.Equal(t, uint64(2), recording.results[0][0].Count)
+	require.Equal(t, "wg2", recording.results[0][1].WorkerGroup)
+	require.Equal(t, "BSV", recording.results[0][1].Coin)
+}
@@ -0,0 +1,281 @@
+package tcpmeasurer
+
+import (
+	"container/list"
+	"fmt"
+	"net/netip"
+	"orchestrator/common/pkg/sketch"
+	"orchestrator/common/pkg/utils"
+	"slices"
+	"strings"
+	"time"
+)
+
+// connection table: miner connection is opened by SYN of the miner, or by the first packet if capture starts in the
+// middle of it, and closed by RST, FIN of both sides or idle timeout. Samples of the window are kept by miner address,
+// so worker group of the closed connection is evicted only after the window of its last packet is written.
+// New connection from the same address (e.g. NAT reuses the port) retires the previous one: its samples of open windows
+// are moved to the retired key together with the worker group, so the new miner does not inherit it.
+
+// defaultConnectionIdleTimeout is how long by event time the connection may stay without packets before it is evicted
+const defaultConnectionIdleTimeout = 10 * time.Minute
+
+// WithConnectionIdleTimeout sets how long by event time the connection without packets is kept in the connection table
+func WithConnectionIdleTimeout(timeout time.Duration) Opt {
+	return func(s *Service) {
+		if timeout > 0 {
+			s.idleTimeout = timeout
+		}
+	}
+}
+
+// connKey is the miner and stratum addresses of the connection, state is keyed by it without formatting addresses per
+// packet, they are formatted only for output. Miner which is connected to several stratum addresses from the same
+// port has a connection per stratum address.
+type connKey struct {
+	miner   netip.AddrPort
+	stratum netip.AddrPort
+	retired int64 // open time in unix nanoseconds of the connection retired by port reuse, zero for current one
+}
+
+// String returns miner address `1.2.3.4:5` or `[2001:db8::1]:5`, retired connection has `#<open time>` suffix
+func (k connKey) String() string {
+	if k.retired == 0 {
+		return k.miner.String()
+	}
+	return fmt.Sprintf("%s#%d", k.miner, k.retired)
+}
+
+type connection struct {
+	openedAt   time.Time
+	lastSeen   time.Time
+	closedAt   time.Time // zero while the connection is open
+	worker     string    // worker group, empty until the miner is identified
+	syn        bool      // connection is opened by SYN of the miner, isn is its sequence
+	isn        uint32
+	packetsIn  uint64 // from the miner to the stratum
+	packetsOut uint64
+	bytesIn    uint64 // tcp payload
+	bytesOut   uint64
+	flow       flowState     // sequence state, see retransmissions.go
+	lru        *list.Element // position in s.hostsLRU
+}
+
+// ConnectionInfo is entry of the connection table, in is direction from the miner to the stratum
+type ConnectionInfo struct {
+	Miner       string     `json:"miner"` // `1.2.3.4:5`, retired connection has `#` and open time in unix nanoseconds after it
+	Stratum     string     `json:"stratum"`
+	WorkerGroup string     `json:"worker_group,omitempty"`
+	OpenedAt    time.Time  `json:"opened_at"`
+	LastSeen    time.Time  `json:"last_seen"`
+	ClosedAt    *time.Time `json:"closed_at,omitempty"`
+	PacketsIn   uint64     `json:"packets_in"`
+	PacketsOut  uint64     `json:"packets_out"`
+	BytesIn     uint64     `json:"bytes_in"`
+	BytesOut    uint64     `json:"bytes_out"`
+}
+
+// trackConnection returns connection of the packet, SYN of the miner opens a new one and retires the previous
+// connection of the address
+func (s *shard) trackConnection(eventTime time.Time, key connKey, isIncoming bool, pkt *tcpPacket, counts *tcpEventCounts) *connection {
+	c, ok := s.connections[key]
+	if isIncoming && pkt.flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN && (!ok || !c.syn || c.isn != pkt.seq) { // retransmitted SYN keeps the connection
+		if ok {
+			s.retireConnection(eventTime, key, c)
+		}
+		c = &connection{openedAt: eventTime, syn: true, isn: pkt.seq}
+		s.connections[key] = c
+		counts[tcpEventOpen]++
+	} else if !ok {
+		c = &connection{openedAt: eventTime}
+		s.connections[key] = c
+	}
+	if c.lru == nil {
+		c.lru = s.hostsLRU.PushFront(key)
+	} else {
+		s.hostsLRU.MoveToFront(c.lru)
+	}
+	c.lastSeen = eventTime
+	if isIncoming {
+		c.packetsIn++
+		c.bytesIn += uint64(pkt.payloadLen)
+	} else {
+		c.packetsOut++
+		c.bytesOut += uint64(pkt.payloadLen)
+	}
+	return c
+}
+
+// retireConnection moves connection of the address with its samples of open windows and worker group to the retired key
+func (s *shard) retireConnection(eventTime time.Time, key connKey, c *connection) {
+	retiredKey := key
+	retiredKey.retired = c.openedAt.UnixNano()
+	s.connections[retiredKey] = c
+	c.lru.Value = retiredKey
+	s.dropConnectionState(key)
+	s.retireHost(key, retiredKey)
+	if s.closeConnection(eventTime, c) { // FIN and RST are not captured
+		s.addTCPEvents(eventTime, retiredKey, &tcpEventCounts{tcpEventClose: 1})
+	}
+}
+
+// closeConnection marks the connection as closed, it returns false if it is already closed
+func (s *shard) closeConnection(eventTime time.Time, c *connection) bool {
+	if !c.closedAt.IsZero() {
+		return false
+	}
+	c.closedAt = eventTime
+	if w, ok := s.workers[c.worker]; ok {
+		w.closed++
+	}
+	return true
+}
+
+// dropConnectionState removes matching state of the connection
+func (s *shard) dropConnectionState(key connKey) {
+	delete(s.dataSeq, key)
+	delete(s.submits, key)
+	delete(s.submitsSeq, key)
+	delete(s.tsSent, key)
+	if _, ok := s.handshakes[key]; ok {
+		delete(s.handshakes, key)
+		s.metrics.halfOpen.Add(1)
+	}
+}
+
+// retireHost moves samples of open windows and worker group of the address to the retired connection
+func (s *shard) retireHost(key, retiredKey connKey) {
+	for _, buffer := range []map[time.Time]map[connKey]*sketch.DDSketch{s.buffer, s.processing, s.handshakeRTT, s.tsRTT} {
+		moveHost(buffer, key, retiredKey)
+	}
+	moveHost(s.shares, key, retiredKey)
+	moveHost(s.events, key, retiredKey)
+	for _, job := range s.notifyJobs {
+		if ackAt, ok := job.deliveries[key]; ok {
+			job.deliveries[retiredKey] = ackAt
+			delete(job.deliveries, key)
+		}
+	}
+	if worker, ok := s.matchedMiners[key]; ok {
+		s.matchedMiners[retiredKey], s.matchedMinersCoin[retiredKey] = worker, s.matchedMinersCoin[key]
+		delete(s.matchedMiners, key)
+		delete(s.matchedMinersCoin, key)
+	}
+}
+
+func moveHost[T any](windows map[time.Time]map[connKey]T, from, to connKey) {
+	for _, hosts := range windows {
+		if value, ok := hosts[from]; ok {
+			hosts[to] = value
+			delete(hosts, from)
+		}
+	}
+}
+
+// workerConnections is state of the worker group for reconnects, it is kept while the connection table has
+// connections of the worker group
+type workerConnections struct {
+	connections int // connections of the worker group in the connection table
+	closed      int // closed or evicted connections which are not followed by a new one yet
+}
+
+// mapConnection saves worker group of the connection, the first mapping of the connection after another connection
+// of the worker group is closed or evicted is counted as reconnect. Concurrent connections are not reconnects.
+func (s *shard) mapConnection(eventTime time.Time, key connKey, worker string) {
+	c, ok := s.connections[key]
+	if !ok || c.worker == worker {
+		return
+	}
+	first := c.worker == ""
+	if !first {
+		s.releaseWorker(c.worker)
+	}
+	c.worker = worker
+	w, ok := s.workers[worker]
+	if !ok {
+		w = &workerConnections{}
+		s.workers[worker] = w
+	}
+	w.connections++
+	if first && w.closed > 0 {
+		w.closed--
+		s.addTCPEvents(eventTime, key, &tcpEventCounts{tcpEventReconnect: 1})
+	}
+}
+
+// releaseWorker drops connection of the worker group, state is dropped with the last connection
+func (s *shard) releaseWorker(worker string) {
+	w, ok := s.workers[worker]
+	if !ok {
+		return
+	}
+	if w.connections--; w.connections <= 0 {
+		delete(s.workers, worker)
+	}
+}
+
+// evictConnections drops connections which are closed or idle since the window of the last packet is written,
+// worker group of the address is dropped with them. It is called after closed windows are processed.
+func (s *Service) evictConnections(watermark time.Time) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.evictConnections(watermark)
+		sh.mu.Unlock()
+	}
+}
+
+func (s *shard) evictConnections(watermark time.Time) {
+	for key, c := range s.connections {
+		if c.closedAt.IsZero() {
+			if c.lastSeen.Add(s.idleTimeout).After(watermark) {
+				continue
+			}
+			s.closeConnection(c.lastSeen, c)
+			s.metrics.idleConnections.Add(1)
+		}
+		if !s.windowClosed(utils.RoundToNearest5Minutes(c.lastSeen), watermark) {
+			continue
+		}
+		s.hostsLRU.Remove(c.lru)
+		s.evictHost(key)
+	}
+}
+
+// Connections returns the connection table sorted by miner and stratum addresses
+func (s *Service) Connections() []ConnectionInfo {
+	var table []ConnectionInfo
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		table = sh.appendConnections(table)
+		sh.mu.Unlock()
+	}
+	slices.SortFunc(table, func(a, b ConnectionInfo) int {
+		if c := strings.Compare(a.Miner, b.Miner); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Stratum, b.Stratum)
+	})
+	return table
+}
+
+func (s *shard) appendConnections(table []ConnectionInfo) []ConnectionInfo {
+	for key, c := range s.connections {
+		info := ConnectionInfo{
+			Miner:       key.String(), // formatted for output only
+			Stratum:     key.stratum.String(),
+			WorkerGroup: c.worker,
+			OpenedAt:    c.openedAt,
+			LastSeen:    c.lastSeen,
+			PacketsIn:   c.packetsIn,
+			PacketsOut:  c.packetsOut,
+			BytesIn:     c.bytesIn,
+			BytesOut:    c.bytesOut,
+		}
+		if !c.closedAt.IsZero() {
+			closedAt := c.closedAt
+			info.ClosedAt = &closedAt
+		}
+		table = append(table, info)
+	}
+	return table
+}
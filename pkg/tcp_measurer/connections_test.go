@@ -0,0 +1,198 @@
+package tcpmeasurer
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Connections_PortReuse(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+	at := time.Date(2024, 5, 31, 13, 41, 0, 0, time.UTC)
+	reconnected := netip.MustParseAddrPort("8.46.207.98:40000")
+
+	// when
+	capture.connect(testMiner, at, 99)
+	capture.authorize(testMiner, at.Add(time.Second), 1000, "wg1.rig")
+	capture.sample(testMiner, 1000, at.Add(2*time.Second), 40*time.Millisecond)
+	capture.connect(testMiner, at.Add(10*time.Second), 4999) // NAT reuses the port for another miner
+	capture.replay(srv)
+	for _, c := range srv.Connections() {
+		if c.Miner == testMiner.String() {
+			require.Empty(t, c.WorkerGroup, "new connection does not inherit worker group")
+		}
+	}
+	capture.sample(testMiner, 2000, at.Add(11*time.Second), 20*time.Millisecond)
+	capture.authorize(testMiner, at.Add(12*time.Second), 2000+uint32(len(testPayload)), "wg2.rig")
+
+	capture.connect(reconnected, at.Add(20*time.Second), 99)
+	capture.authorize(reconnected, at.Add(21*time.Second), 1000, "wg1.rig")
+	capture.send(at.Add(30*time.Second), testSegment{src: reconnected, dst: testStratum, seq: 100, flags: tcpFlagRST})
+	capture.replay(srv)
+	table := srv.Connections()
+	srv.Stop()
+
+	// then
+	require.Len(t, table, 3)
+	retired := table[1]
+	require.Equal(t, fmt.Sprintf("%s#%d", testMiner, at.UnixNano()), retired.Miner)
+	require.Equal(t, "wg1.rig", retired.WorkerGroup)
+	require.NotNil(t, retired.ClosedAt)
+	require.True(t, at.Add(10*time.Second).Equal(*retired.ClosedAt), "closed by SYN of the new connection")
+	require.Equal(t, uint64(3), retired.PacketsIn)
+	require.Equal(t, uint64(1), retired.PacketsOut)
+	require.Equal(t, uint64(len(testPayload)), retired.BytesOut)
+	current := table[0]
+	require.Equal(t, testMiner.String(), current.Miner)
+	require.Equal(t, "wg2.rig", current.WorkerGroup)
+	require.Nil(t, current.ClosedAt)
+	require.Equal(t, reconnected.String(), table[2].Miner)
+	require.NotNil(t, table[2].ClosedAt, "closed by RST")
+
+	require.Len(t, sink.written(), 2)
+	wg1, wg2 := resultOf(t, sink, "wg1.rig"), resultOf(t, sink, "wg2.rig")
+	require.Equal(t, uint64(1), wg1.Count)
+	require.Equal(t, float64(40), wg1.Max, "samples of the previous connection stay with its worker group")
+	require.Equal(t, uint64(2), wg1.ConnectionsOpened)
+	require.Equal(t, uint64(2), wg1.ConnectionsClosed)
+	require.Equal(t, uint64(1), wg1.Reconnects)
+	require.Equal(t, uint64(1), wg2.Count)
+	require.Equal(t, float64(20), wg2.Max)
+	require.Equal(t, uint64(1), wg2.ConnectionsOpened)
+	require.Zero(t, wg2.ConnectionsClosed)
+	require.Zero(t, wg2.Reconnects, "worker group is not seen before")
+}
+
+func TestService_Connections_Eviction(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithAllowedLateness(time.Minute), WithConnectionIdleTimeout(5*time.Minute))
+	capture := newCapture(t)
+	at := func(minute, sec int) time.Time {
+		return time.Date(2024, 5, 31, 13, minute, sec, 0, time.UTC)
+	}
+	idle := netip.MustParseAddrPort("8.46.207.96:23914")
+	active := netip.MustParseAddrPort("8.46.207.97:23914")
+
+	capture.connect(testMiner, at(41, 0), 99)
+	capture.authorize(testMiner, at(41, 1), 1000, "wg1.rig")
+	capture.sample(testMiner, 1000, at(41, 2), 10*time.Millisecond)
+	capture.send(at(41, 3), testSegment{src: testMiner, dst: testStratum, seq: 200, flags: tcpFlagFIN | tcpFlagACK})
+	capture.send(at(41, 4), testSegment{src: testStratum, dst: testMiner, seq: 2000, flags: tcpFlagFIN | tcpFlagACK})
+	capture.connect(idle, at(44, 0), 99)
+	capture.authorize(idle, at(44, 1), 1000, "wg2.rig")
+	capture.send(at(44, 2), response(idle, 1000)) // never acknowledged
+
+	// when
+	capture.sample(active, 1000, at(47, 0), 10*time.Millisecond)
+	capture.replay(srv)
+	srv.DumpIt()
+
+	// then
+	require.Len(t, sink.written(), 2, "closed connection keeps worker group until its window is written")
+	require.Equal(t, uint64(1), resultOf(t, sink, "wg1.rig").ConnectionsClosed)
+	require.Len(t, srv.Connections(), 2, "idle timeout is not passed yet")
+
+	// when
+	capture.sample(active, 2000, at(49, 30), 10*time.Millisecond)
+	capture.replay(srv)
+	srv.DumpIt()
+
+	// then
+	table := srv.Connections()
+	require.Len(t, table, 1)
+	require.Equal(t, active.String(), table[0].Miner)
+	metrics := metricsText(t, srv)
+	require.Contains(t, metrics, "tcpmeasurer_connections 1\n")
+	require.Contains(t, metrics, "tcpmeasurer_idle_connections_evicted_total 1\n")
+	require.Contains(t, metrics, "tcpmeasurer_matched_miners 0\n", "worker groups of closed and idle connections are evicted")
+}
+
+func TestService_Connections_Reconnects(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithAllowedLateness(time.Minute))
+	capture := newCapture(t)
+	at := func(minute, sec int) time.Time {
+		return time.Date(2024, 5, 31, 13, minute, sec, 0, time.UTC)
+	}
+	concurrent := netip.MustParseAddrPort("8.46.207.96:23914")
+	reconnected := netip.MustParseAddrPort("8.46.207.97:23914")
+	forgotten := netip.MustParseAddrPort("8.46.207.98:23914")
+	watermark := netip.MustParseAddrPort("8.46.207.99:23914") // moves the watermark
+
+	// when
+	capture.connect(testMiner, at(41, 0), 99)
+	capture.authorize(testMiner, at(41, 1), 1000, "wg1.rig")
+	capture.connect(concurrent, at(41, 2), 99)
+	capture.authorize(concurrent, at(41, 3), 1000, "wg1.rig")
+	capture.send(at(41, 4), testSegment{src: testMiner, dst: testStratum, seq: 100, flags: tcpFlagRST})
+	capture.connect(reconnected, at(41, 5), 99)
+	capture.authorize(reconnected, at(41, 6), 1000, "wg1.rig")
+	capture.send(at(41, 7), testSegment{src: concurrent, dst: testStratum, seq: 100, flags: tcpFlagRST})
+	capture.send(at(41, 8), testSegment{src: reconnected, dst: testStratum, seq: 100, flags: tcpFlagRST})
+	capture.sample(watermark, 1000, at(47, 0), 10*time.Millisecond)
+	capture.replay(srv)
+	srv.DumpIt() // closed connections are evicted with the 13:40 window
+
+	capture.connect(forgotten, at(47, 1), 99)
+	capture.authorize(forgotten, at(47, 2), 1000, "wg1.rig")
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	results := sink.written()
+	require.Len(t, results, 2)
+	require.True(t, at(40, 0).Equal(results[0].Interval))
+	require.Equal(t, uint64(3), results[0].ConnectionsOpened)
+	require.Equal(t, uint64(3), results[0].ConnectionsClosed)
+	require.Equal(t, uint64(1), results[0].Reconnects, "concurrent connection is not reconnect")
+	require.True(t, at(45, 0).Equal(results[1].Interval))
+	require.Equal(t, uint64(1), results[1].ConnectionsOpened)
+	require.Zero(t, results[1].Reconnects, "worker group is forgotten with its last connection")
+}
+
+func TestService_Connections_StratumAddresses(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+	at := time.Date(2024, 5, 31, 13, 41, 0, 0, time.UTC)
+	backup := netip.MustParseAddrPort("172.29.54.142:3333")
+
+	// when
+	capture.connect(testMiner, at, 99)
+	capture.authorize(testMiner, at.Add(time.Second), 1000, "wg1.rig")
+	capture.send(at.Add(2*time.Second), testSegment{src: testMiner, dst: backup, seq: 4999, flags: tcpFlagSYN}) // the same port to another stratum
+	authorize := request(testMiner, 100, 1000, `{"id":1,"method":"mining.authorize","params":["wg2.rig","x"]}`+"\n")
+	authorize.dst = backup
+	capture.send(at.Add(3*time.Second), authorize)
+	capture.sample(testMiner, 1000, at.Add(4*time.Second), 10*time.Millisecond)
+	backupResponse := response(testMiner, 1000)
+	backupResponse.src = backup
+	capture.send(at.Add(5*time.Second-30*time.Millisecond), backupResponse)
+	capture.send(at.Add(5*time.Second), testSegment{src: testMiner, dst: backup, seq: 100, ack: 1000 + uint32(len(testPayload)), flags: tcpFlagACK, window: 502})
+	capture.replay(srv)
+	table := srv.Connections()
+	srv.Stop()
+
+	// then
+	require.Len(t, table, 2)
+	require.Equal(t, testMiner.String(), table[0].Miner)
+	require.Equal(t, testStratum.String(), table[0].Stratum)
+	require.Equal(t, "wg1.rig", table[0].WorkerGroup)
+	require.Nil(t, table[0].ClosedAt, "SYN to another stratum does not retire the connection")
+	require.Equal(t, testMiner.String(), table[1].Miner)
+	require.Equal(t, backup.String(), table[1].Stratum)
+	require.Equal(t, "wg2.rig", table[1].WorkerGroup)
+
+	require.Len(t, sink.written(), 2)
+	require.Equal(t, float64(10), resultOf(t, sink, "wg1.rig").Max)
+	require.Equal(t, float64(30), resultOf(t, sink, "wg2.rig").Max)
+}
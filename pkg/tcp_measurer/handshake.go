@@ -0,0 +1,62 @@
+package tcpmeasurer
+
+import "time"
+
+// handshake RTT is time between SYN-ACK of the stratum and ACK of the miner, the miner acknowledges it immediately,
+// so unlike data ACK there is no delayed ACK in it. RTT is reported once the connection is mapped to the worker group.
+
+// handshakeTimeout is how long by event time the handshake may stay incomplete before it is counted as half-open
+const handshakeTimeout = 30 * time.Second
+
+type handshake struct {
+	synAt         time.Time
+	synAckAt      time.Time // zero until SYN-ACK of the stratum is captured
+	nextSeq       uint32    // acknowledgment number which completes the handshake
+	retransmitted bool      // SYN-ACK is sent again, it is not known which one is acknowledged
+}
+
+// processHandshake tracks SYN, SYN-ACK and ACK of the miner connection, it returns true if the packet is consumed
+func (s *shard) processHandshake(eventTime time.Time, key connKey, isIncoming bool, pkt *tcpPacket) bool {
+	syn, ack := pkt.flags&tcpFlagSYN != 0, pkt.flags&tcpFlagACK != 0
+	switch {
+	case syn && !ack && isIncoming:
+		if _, ok := s.handshakes[key]; !ok {
+			s.handshakes[key] = &handshake{synAt: eventTime} // retransmitted SYN keeps the first one
+		}
+		return true
+	case syn && ack && !isIncoming:
+		if h, ok := s.handshakes[key]; ok {
+			h.retransmitted = !h.synAckAt.IsZero()
+			h.synAckAt = eventTime
+			h.nextSeq = pkt.seq + 1
+		}
+		return true
+	case syn:
+		return true
+	case !isIncoming || !ack:
+		return false
+	}
+
+	h, ok := s.handshakes[key]
+	if !ok || h.synAckAt.IsZero() || pkt.ack != h.nextSeq {
+		return false
+	}
+	delete(s.handshakes, key)
+	s.metrics.handshakes.Add(1)
+	if !h.retransmitted {
+		s.addHandshake(eventTime, key, eventTime.Sub(h.synAckAt))
+	}
+	return pkt.payloadLen == 0 // first request of the miner may come with the ACK
+}
+
+// expireHandshakes counts handshakes which are not completed in handshakeTimeout as half-open and drops them,
+// caller should hold s.mu
+func (s *shard) expireHandshakes(watermark time.Time) {
+	dropBefore := watermark.Add(-handshakeTimeout)
+	for key, h := range s.handshakes {
+		if h.synAt.Before(dropBefore) {
+			delete(s.handshakes, key)
+			s.metrics.halfOpen.Add(1)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package tcpmeasurer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Handshake(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+	send := func(after time.Duration, seg testSegment) {
+		capture.send(captureStart.Add(after), seg)
+	}
+	retransmitting := netip.MustParseAddrPort("8.46.207.96:23914")
+	halfOpen := netip.MustParseAddrPort("8.46.207.97:23914")
+
+	// when
+	send(0, testSegment{src: testMiner, dst: testStratum, seq: 99, flags: tcpFlagSYN})
+	send(time.Millisecond, testSegment{src: testMiner, dst: testStratum, seq: 99, flags: tcpFlagSYN}) // retransmitted
+	send(2*time.Millisecond, testSegment{src: testStratum, dst: testMiner, seq: 999, ack: 100, flags: tcpFlagSYN | tcpFlagACK})
+	send(3*time.Millisecond, testSegment{src: testMiner, dst: testStratum, seq: 100, ack: 999, flags: tcpFlagACK}) // does not acknowledge SYN-ACK
+	send(42*time.Millisecond, testSegment{src: testMiner, dst: testStratum, seq: 100, ack: 1000, flags: tcpFlagACK})
+	send(43*time.Millisecond, request(testMiner, 100, 1000, `{"id":1,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n"))
+
+	send(0, testSegment{src: retransmitting, dst: testStratum, seq: 99, flags: tcpFlagSYN})
+	send(time.Millisecond, testSegment{src: testStratum, dst: retransmitting, seq: 999, ack: 100, flags: tcpFlagSYN | tcpFlagACK})
+	send(time.Second, testSegment{src: testStratum, dst: retransmitting, seq: 999, ack: 100, flags: tcpFlagSYN | tcpFlagACK})
+	send(time.Second+40*time.Millisecond, request(retransmitting, 100, 1000, `{"id":1,"method":"mining.authorize","params":["wg2.rig","x"]}`+"\n"))
+
+	send(0, testSegment{src: halfOpen, dst: testStratum, seq: 99, flags: tcpFlagSYN})
+	send(time.Millisecond, testSegment{src: testStratum, dst: halfOpen, seq: 999, ack: 100, flags: tcpFlagSYN | tcpFlagACK})
+	send(30*time.Second, response(testMiner, 1000)) // watermark reaches handshake timeout
+	capture.replay(srv)
+	srv.CleanIt()
+	require.Contains(t, metricsText(t, srv), "tcpmeasurer_half_open_handshakes_total 0\n", "handshake is not expired yet")
+	send(30*time.Second+time.Millisecond, response(testMiner, 1000+uint32(len(testPayload))))
+	capture.replay(srv)
+	srv.CleanIt()
+	srv.Stop()
+
+	// then
+	metrics := metricsText(t, srv)
+	require.Contains(t, metrics, "tcpmeasurer_handshakes_total 2\n")
+	require.Contains(t, metrics, "tcpmeasurer_half_open_handshakes_total 1\n")
+	require.Contains(t, metrics, "tcpmeasurer_unmatched_acks_total 1\n", "ACK of the handshake is not a data ACK")
+	require.Len(t, sink.written(), 2)
+	wg1, wg2 := resultOf(t, sink, "wg1.rig"), resultOf(t, sink, "wg2.rig")
+	require.Zero(t, wg2.HandshakeCount, "SYN-ACK is retransmitted")
+	require.Equal(t, uint64(1), wg2.MinerACKs, "first request comes with the ACK")
+	require.Equal(t, uint64(1), wg1.HandshakeCount)
+	require.InDelta(t, 40, wg1.HandshakeMedian, 40*0.01)
+	require.Equal(t, float64(40), wg1.HandshakeMax)
+}
+
+func TestService_Handshake_Capture(t *testing.T) {
+	srv := newTestService(t)
+
+	require.NoError(t, srv.ReadFilePureGO("samples/caapture-20240531134340.pcap"))
+
+	metrics := metricsText(t, srv)
+	require.Contains(t, metrics, "tcpmeasurer_handshakes_total 32\n")
+	require.Contains(t, metrics, "tcpmeasurer_half_open_handshakes_total 0\n")
+}
@@ -0,0 +1,197 @@
+package tcpmeasurer
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestService(t testing.TB, opts ...Opt) *Service {
+	appLogger, err := logger.NewAppSLogger(&logger.Config{Progname: "orca_mapicron"}, "")
+	require.NoError(t, err)
+	// single shard keeps state of all connections in srv.shards[0], Stop drains files of the test only
+	return NewService(context.Background(), appLogger, 3333, append([]Opt{WithShards(1), WithFilesPath(t.TempDir())}, opts...)...)
+}
+
+var (
+	testStratum  = netip.MustParseAddrPort("172.29.54.141:3333")
+	testMiner    = netip.MustParseAddrPort("8.46.207.95:23914")
+	testStratum6 = netip.MustParseAddrPort("[2001:db8::1]:3333")
+	testMiner6   = netip.MustParseAddrPort("[2001:db8:5::95]:23914")
+	testPayload  = []byte(`{"id":171118,"result":true,"error":null}`)
+	testTSOption = []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2} // nop, nop, timestamps
+)
+
+type testSegment struct {
+	src     netip.AddrPort
+	dst     netip.AddrPort
+	seq     uint32
+	ack     uint32
+	flags   TCPFlags
+	window  uint16
+	options []byte
+	payload []byte
+}
+
+// testResponse is stratum response to the miner with seq 3568706784 and ack 2396494875
+func testResponse(stratum, miner netip.AddrPort) testSegment {
+	return testSegment{
+		src:     stratum,
+		dst:     miner,
+		seq:     3568706784,
+		ack:     2396494875,
+		flags:   tcpFlagACK | tcpFlagPSH,
+		window:  502,
+		payload: testPayload,
+	}
+}
+
+func (seg testSegment) tcp() []byte {
+	header := make([]byte, 20+len(seg.options))
+	binary.BigEndian.PutUint16(header[0:2], seg.src.Port())
+	binary.BigEndian.PutUint16(header[2:4], seg.dst.Port())
+	binary.BigEndian.PutUint32(header[4:8], seg.seq)
+	binary.BigEndian.PutUint32(header[8:12], seg.ack)
+	header[12] = byte(len(header)/4) << 4
+	header[13] = byte(seg.flags)
+	binary.BigEndian.PutUint16(header[14:16], seg.window)
+	copy(header[20:], seg.options)
+	return append(header, seg.payload...)
+}
+
+// ip wraps segment into IPv4 or IPv6 packet depending on the address family
+func (seg testSegment) ip() []byte {
+	if seg.src.Addr().Is4() {
+		return buildIPv4(seg, nil)
+	}
+	return buildIPv6(seg)
+}
+
+func buildIPv4(seg testSegment, options []byte) []byte {
+	segment := seg.tcp()
+	header := make([]byte, 20+len(options))
+	header[0] = 0x40 | byte(len(header)/4)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(segment)))
+	header[8] = 64
+	header[9] = ipProtocolTCP
+	src, dst := seg.src.Addr().As4(), seg.dst.Addr().As4()
+	copy(header[12:16], src[:])
+	copy(header[16:20], dst[:])
+	copy(header[20:], options)
+	return append(header, segment...)
+}
+
+// buildIPv6 adds extension headers of minimal size in the given order
+func buildIPv6(seg testSegment, extHeaders ...uint8) []byte {
+	header := make([]byte, 40)
+	header[0] = 0x60
+	header[7] = 64
+	src, dst := seg.src.Addr().As16(), seg.dst.Addr().As16()
+	copy(header[8:24], src[:])
+	copy(header[24:40], dst[:])
+	nextHeader := &header[6]
+	for _, kind := range extHeaders {
+		*nextHeader = kind
+		ext := make([]byte, 8)
+		if kind == ipv6AuthHeader {
+			ext = make([]byte, 12)
+			ext[1] = 1
+		}
+		header = append(header, ext...)
+		nextHeader = &header[len(header)-len(ext)]
+	}
+	*nextHeader = ipProtocolTCP
+	header = append(header, seg.tcp()...)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(header)-40))
+	return header
+}
+
+// buildEthernet wraps network packet into ethernet frame, every extra ethertype adds a vlan tag
+func buildEthernet(network []byte, etherTypes ...uint16) []byte {
+	frame := make([]byte, 12, 64)
+	for _, etherType := range etherTypes {
+		frame = binary.BigEndian.AppendUint16(frame, etherType)
+		frame = binary.BigEndian.AppendUint16(frame, 42) // vlan id
+	}
+	frame = binary.BigEndian.AppendUint16(frame, networkEtherType(network))
+	return append(frame, network...)
+}
+
+func buildSLL(network []byte) []byte {
+	frame := make([]byte, 16, 16+len(network))
+	binary.BigEndian.PutUint16(frame[14:16], networkEtherType(network))
+	return append(frame, network...)
+}
+
+func buildSLL2(network []byte) []byte {
+	frame := make([]byte, 20, 20+len(network))
+	binary.BigEndian.PutUint16(frame[0:2], networkEtherType(network))
+	return append(frame, network...)
+}
+
+func networkEtherType(network []byte) uint16 {
+	if len(network) > 0 && network[0]>>4 == 6 {
+		return etherTypeIPv6
+	}
+	return etherTypeIPv4
+}
+
+// testFrame is frame of the in-memory capture
+type testFrame struct {
+	at    time.Time
+	frame []byte
+}
+
+// frameSource is in-memory capture of linux cooked frames, tests pass it through Service.ReadSource the same way as
+// capture files
+type frameSource []testFrame
+
+func (f frameSource) ReadPackets(handler PacketHandler) error {
+	decode := decodeFrames(handler)
+	for _, fr := range f {
+		decode(fr.at, linkTypeLinuxSLL, fr.frame)
+	}
+	return nil
+}
+
+func (f frameSource) Close() error {
+	return nil
+}
+
+// replaySegments passes segments captured at the time through the service
+func replaySegments(t testing.TB, srv *Service, at time.Time, segments ...testSegment) {
+	t.Helper()
+	src := make(frameSource, len(segments))
+	for i, seg := range segments {
+		src[i] = testFrame{at: at, frame: buildSLL(seg.ip())}
+	}
+	require.NoError(t, srv.ReadSource(src))
+}
+
+// writeCapture writes frames into pcap file with nanosecond timestamps the same way as tcpdump does
+func writeCapture(t testing.TB, frames frameSource) string {
+	t.Helper()
+	data := make([]byte, 24)
+	binary.LittleEndian.PutUint32(data[0:4], 0xa1b23c4d)
+	binary.LittleEndian.PutUint16(data[4:6], 2)
+	binary.LittleEndian.PutUint16(data[6:8], 4)
+	binary.LittleEndian.PutUint32(data[16:20], 65535)
+	binary.LittleEndian.PutUint32(data[20:24], linkTypeLinuxSLL)
+	for _, fr := range frames {
+		data = binary.LittleEndian.AppendUint32(data, uint32(fr.at.Unix()))
+		data = binary.LittleEndian.AppendUint32(data, uint32(fr.at.Nanosecond()))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(fr.frame)))
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(fr.frame)))
+		data = append(data, fr.frame...)
+	}
+	file := filepath.Join(t.TempDir(), "caapture-1.pcap")
+	require.NoError(t, os.WriteFile(file, data, 0o600))
+	return file
+}
@@ -0,0 +1,130 @@
+package tcpmeasurer
+
+import (
+	"orchestrator/common/pkg/sketch"
+	"time"
+)
+
+// state of the miner connections is bounded, so scan or heavy churn does not grow memory: connection table keeps at most
+// maxHosts addresses and evicts the least recently seen one together with its matching state and worker group, samples
+// of the evicted address in open windows are dropped as well, they have no worker group to be written with.
+// Matching state of the address (stratum segments waiting for ACK, submits waiting for response, TCP timestamps waiting
+// for echo) keeps at most maxHostEntries entries of every kind and evicts the oldest one, entries older than maxIdleAge
+// by event time are dropped by CleanIt.
+
+const (
+	defaultMaxHosts       = 100_000
+	defaultMaxHostEntries = 256
+	defaultMaxIdleAge     = 5 * time.Minute
+)
+
+// WithMaxHosts limits number of miner addresses in the connection table, the least recently seen one is evicted
+func WithMaxHosts(maxHosts int) Opt {
+	return func(s *Service) {
+		if maxHosts > 0 {
+			s.maxHosts = maxHosts
+		}
+	}
+}
+
+// WithMaxSegmentsPerHost limits stratum segments waiting for ACK of the miner, the oldest one is evicted.
+// Submits waiting for response and TCP timestamps waiting for echo are limited the same way.
+func WithMaxSegmentsPerHost(maxEntries int) Opt {
+	return func(s *Service) {
+		if maxEntries > 0 {
+			s.maxHostEntries = maxEntries
+		}
+	}
+}
+
+// WithMaxIdleAge sets how long by event time segment, submit or timestamp is kept without the matching packet
+func WithMaxIdleAge(age time.Duration) Opt {
+	return func(s *Service) {
+		if age > 0 {
+			s.maxIdleAge = age
+		}
+	}
+}
+
+// evictHosts drops the least recently seen connections while the shard is over its share of maxHosts,
+// the connection of the current packet is the most recent one, so it is kept
+func (s *shard) evictHosts() {
+	for len(s.connections) > s.hostsLimit {
+		s.evictHost(s.hostsLRU.Remove(s.hostsLRU.Back()).(connKey))
+		s.metrics.hostsEvicted.Add(1)
+	}
+}
+
+// evictHost drops connection of the address with its matching state, worker group and samples of open windows,
+// caller removes it from s.hostsLRU
+func (s *shard) evictHost(key connKey) {
+	if c, ok := s.connections[key]; ok && c.worker != "" {
+		if w, ok := s.workers[c.worker]; ok && c.closedAt.IsZero() {
+			w.closed++
+		}
+		s.releaseWorker(c.worker)
+	}
+	delete(s.connections, key)
+	s.dropConnectionState(key)
+	delete(s.matchedMiners, key)
+	delete(s.matchedMinersCoin, key)
+	for _, buffer := range []map[time.Time]map[connKey]*sketch.DDSketch{s.buffer, s.processing, s.handshakeRTT, s.tsRTT} {
+		dropHost(buffer, key)
+	}
+	dropHost(s.shares, key)
+	dropHost(s.events, key)
+	for _, job := range s.notifyJobs {
+		delete(job.deliveries, key)
+	}
+}
+
+func dropHost[T any](windows map[time.Time]map[connKey]T, key connKey) {
+	for _, hosts := range windows {
+		delete(hosts, key)
+	}
+}
+
+// makeRoom evicts the oldest entry of the full host state before the new key is saved,
+// it returns true if entry is evicted
+func makeRoom[K comparable, V any](entries map[K]V, key K, limit int, at func(V) time.Time) bool {
+	if _, ok := entries[key]; ok || len(entries) < limit {
+		return false
+	}
+	var (
+		oldestKey K
+		oldest    time.Time
+		found     bool
+	)
+	for k, v := range entries {
+		if t := at(v); !found || t.Before(oldest) {
+			oldestKey, oldest, found = k, t, true
+		}
+	}
+	delete(entries, oldestKey)
+	return true
+}
+
+// dropStale drops entries older than dropBefore and addresses without entries, it returns number of dropped entries
+func dropStale[K comparable, V any](hosts map[connKey]map[K]V, dropBefore time.Time, at func(V) time.Time) uint64 {
+	var dropped uint64
+	for key, entries := range hosts {
+		for k, v := range entries {
+			if at(v).Before(dropBefore) {
+				delete(entries, k)
+				dropped++
+			}
+		}
+		if len(entries) == 0 {
+			delete(hosts, key)
+		}
+	}
+	return dropped
+}
+
+func segmentSentAt(mc MeasurerContainer) time.Time {
+	return mc.EventTime
+}
+
+func timeOf(t time.Time) time.Time {
+	return t
+}
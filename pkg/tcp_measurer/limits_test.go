@@ -0,0 +1,110 @@
+package tcpmeasurer
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// churn connects miners from new addresses, every miner authorizes and gets stratum segments it never acknowledges
+func (c *capture) churn(start time.Time, from, to int) {
+	for i := from; i < to; i++ {
+		miner := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)}), uint16(20000+i%40000))
+		at := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		c.connect(miner, at, 99)
+		c.authorize(miner, at.Add(time.Millisecond), 1000, fmt.Sprintf("wg%d.rig", i%10))
+		for seq := uint32(0); seq < 8; seq++ {
+			c.send(at.Add(2*time.Millisecond), response(miner, 1000+seq*uint32(len(testPayload))))
+		}
+	}
+}
+
+func TestService_Limits_Churn(t *testing.T) {
+	// given
+	const miners = 40_000
+	srv := newTestService(t, WithMaxHosts(1000), WithMaxSegmentsPerHost(4))
+	capture := newCapture(t)
+	start := time.Date(2024, 5, 31, 13, 40, 0, 0, time.UTC)
+	heapAlloc := func() uint64 {
+		srv.DumpIt()
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	// when
+	capture.churn(start, 0, miners/2)
+	capture.replay(srv)
+	half := heapAlloc()
+	capture.churn(start, miners/2, miners)
+	capture.replay(srv)
+	full := heapAlloc()
+
+	// then
+	require.Len(t, srv.Connections(), 1000)
+	metrics := metricsText(t, srv)
+	require.Contains(t, metrics, "tcpmeasurer_connections 1000\n")
+	require.Contains(t, metrics, "tcpmeasurer_matched_miners 1000\n")
+	require.Contains(t, metrics, fmt.Sprintf("tcpmeasurer_hosts_evicted_total %d\n", miners-1000))
+	require.Contains(t, metrics, fmt.Sprintf("tcpmeasurer_entries_evicted_total %d\n", miners*4), "only the last 4 segments of the miner are kept")
+	require.Less(t, full, half+8<<20, "heap grows with churn: %d MiB after the first half, %d MiB after all", half>>20, full>>20)
+}
+
+func TestService_Limits_LRU(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithMaxHosts(2))
+	capture := newCapture(t)
+	at := time.Date(2024, 5, 31, 13, 41, 0, 0, time.UTC)
+	recent := netip.MustParseAddrPort("8.46.207.96:23914")
+	evicted := netip.MustParseAddrPort("8.46.207.97:23914")
+
+	// when
+	capture.connect(testMiner, at, 99)
+	capture.authorize(testMiner, at.Add(time.Second), 1000, "wg1.rig")
+	capture.connect(evicted, at.Add(2*time.Second), 99)
+	capture.authorize(evicted, at.Add(3*time.Second), 1000, "wg2.rig")
+	capture.sample(testMiner, 1000, at.Add(4*time.Second), 10*time.Millisecond) // testMiner is seen again
+	capture.connect(recent, at.Add(5*time.Second), 99)
+	capture.replay(srv)
+	table := srv.Connections()
+	metrics := metricsText(t, srv)
+	srv.Stop()
+
+	// then
+	require.Len(t, table, 2)
+	require.Equal(t, testMiner.String(), table[0].Miner)
+	require.Equal(t, "wg1.rig", table[0].WorkerGroup)
+	require.Equal(t, recent.String(), table[1].Miner)
+	require.Contains(t, metrics, "tcpmeasurer_hosts_evicted_total 1\n")
+	require.Contains(t, metrics, "tcpmeasurer_matched_miners 1\n", "worker group is evicted with the connection")
+	require.Equal(t, uint64(1), resultOf(t, sink, "wg1.rig").Count)
+}
+
+func TestService_CleanIt(t *testing.T) {
+	// given
+	srv := newTestService(t, WithMaxIdleAge(time.Minute))
+	capture := newCapture(t)
+	at := time.Date(2024, 5, 31, 13, 41, 0, 0, time.UTC)
+	stale := netip.MustParseAddrPort("8.46.207.96:23914")
+	capture.send(at, response(stale, 1000))
+	capture.send(at.Add(2*time.Minute), response(testMiner, 1000))
+	capture.replay(srv)
+
+	// when
+	srv.CleanIt()
+	capture.send(at.Add(2*time.Minute+time.Second), testSegment{src: stale, dst: testStratum, seq: 100, ack: 1000 + uint32(len(testPayload)), flags: tcpFlagACK})
+	capture.send(at.Add(2*time.Minute+time.Second), testSegment{src: testMiner, dst: testStratum, seq: 100, ack: 1000 + uint32(len(testPayload)), flags: tcpFlagACK})
+	capture.replay(srv)
+
+	// then
+	metrics := metricsText(t, srv)
+	require.Contains(t, metrics, "tcpmeasurer_stale_entries_dropped_total 1\n")
+	require.Contains(t, metrics, "tcpmeasurer_latency_samples_total 1\n", "segment of the recent miner is kept")
+	require.Contains(t, metrics, "tcpmeasurer_unmatched_acks_total 1\n", "segment of the stale miner is dropped")
+}
@@ -0,0 +1,273 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"orchestrator/common/pkg/sketch"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var latencyQuantiles = []float64{0.5, 0.95, 0.99}
+
+// metrics keeps state exported in prometheus text format, see https://prometheus.io/docs/instrumenting/exposition_formats/
+type metrics struct {
+	filesParsed       atomic.Uint64
+	parseErrors       atomic.Uint64
+	captureRestarts   atomic.Uint64
+	unmatchedACKs     atomic.Uint64 // confirmations without stored stratum response
+	latencySamples    atomic.Uint64 // matched samples before aggregation
+	lateSamples       atomic.Uint64 // samples dropped because the window is already closed
+	processingSamples atomic.Uint64 // submits matched with the stratum response
+	notifyDeliveries  atomic.Uint64 // miner ACKs of mining.notify
+	timestampSamples  atomic.Uint64 // RTT samples by TCP timestamps
+	handshakes        atomic.Uint64 // completed handshakes, including ones with retransmitted SYN-ACK
+	halfOpen          atomic.Uint64 // handshakes which are not completed in handshakeTimeout
+	idleConnections   atomic.Uint64 // connections evicted without RST or FIN
+	hostsEvicted      atomic.Uint64 // least recently seen connections evicted over maxHosts
+	entriesEvicted    atomic.Uint64 // oldest segments, submits and timestamps evicted over maxHostEntries
+	staleEntries      atomic.Uint64 // segments, submits and timestamps dropped after maxIdleAge
+
+	mu         sync.Mutex
+	latency    map[latencyLabels]*latencySummary
+	processing map[latencyLabels]*latencySummary
+	shares     map[latencyLabels]*shareCounts    // cumulative
+	events     map[latencyLabels]*tcpEventCounts // cumulative
+	handshake  map[latencyLabels]*latencySummary
+	timestamps map[latencyLabels]*latencySummary
+	delivery   map[latencyLabels]*latencySummary
+	spread     map[latencyLabels]*latencySummary
+}
+
+type latencyLabels struct {
+	workerGroup string
+	coin        string
+}
+
+// latencySummary follows prometheus summary semantics: quantiles are for the last closed window, count and sum are cumulative
+type latencySummary struct {
+	quantiles []float64 // seconds, same order as latencyQuantiles
+	count     uint64
+	sum       float64 // seconds
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		latency:    make(map[latencyLabels]*latencySummary),
+		processing: make(map[latencyLabels]*latencySummary),
+		shares:     make(map[latencyLabels]*shareCounts),
+		events:     make(map[latencyLabels]*tcpEventCounts),
+		handshake:  make(map[latencyLabels]*latencySummary),
+		timestamps: make(map[latencyLabels]*latencySummary),
+		delivery:   make(map[latencyLabels]*latencySummary),
+		spread:     make(map[latencyLabels]*latencySummary),
+	}
+}
+
+func WithMetricsAddr(addr string) Opt {
+	return func(s *Service) {
+		s.metricsAddr = addr
+	}
+}
+
+// observeWindow saves aggregated latency of the worker group, latency is in nanoseconds
+func (m *metrics) observeWindow(workerGroup, coin string, latency *sketch.DDSketch) {
+	m.observe(m.latency, workerGroup, coin, latency)
+}
+
+// observeProcessing saves aggregated submit processing time of the worker group, it is in nanoseconds
+func (m *metrics) observeProcessing(workerGroup, coin string, processing *sketch.DDSketch) {
+	m.observe(m.processing, workerGroup, coin, processing)
+}
+
+// observeTimestampRTT saves aggregated RTT by TCP timestamps of the worker group, it is in nanoseconds
+func (m *metrics) observeTimestampRTT(workerGroup, coin string, rtt *sketch.DDSketch) {
+	m.observe(m.timestamps, workerGroup, coin, rtt)
+}
+
+// observeHandshake saves aggregated handshake RTT of the worker group, it is in nanoseconds
+func (m *metrics) observeHandshake(workerGroup, coin string, rtt *sketch.DDSketch) {
+	m.observe(m.handshake, workerGroup, coin, rtt)
+}
+
+// observeNotify saves mining.notify delivery and spread of the worker group, they are in nanoseconds
+func (m *metrics) observeNotify(workerGroup, coin string, stats *notifyStats) {
+	m.observe(m.delivery, workerGroup, coin, stats.delivery)
+	m.observe(m.spread, workerGroup, coin, stats.spread)
+}
+
+// observeShares adds submit results of the worker group
+func (m *metrics) observeShares(workerGroup, coin string, counts *shareCounts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := latencyLabels{workerGroup: workerGroup, coin: coin}
+	if _, ok := m.shares[labels]; !ok {
+		m.shares[labels] = &shareCounts{}
+	}
+	m.shares[labels].merge(counts)
+}
+
+// observeTCPEvents adds retransmits, duplicate ACKs, RST and FIN of the worker group
+func (m *metrics) observeTCPEvents(workerGroup, coin string, counts *tcpEventCounts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := latencyLabels{workerGroup: workerGroup, coin: coin}
+	if _, ok := m.events[labels]; !ok {
+		m.events[labels] = &tcpEventCounts{}
+	}
+	m.events[labels].merge(counts)
+}
+
+func (m *metrics) observe(summaries map[latencyLabels]*latencySummary, workerGroup, coin string, values *sketch.DDSketch) {
+	quantiles := make([]float64, len(latencyQuantiles))
+	for i, q := range latencyQuantiles {
+		quantiles[i] = values.Quantile(q) / float64(time.Second)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := latencyLabels{workerGroup: workerGroup, coin: coin}
+	summary, ok := summaries[labels]
+	if !ok {
+		summary = &latencySummary{}
+		summaries[labels] = summary
+	}
+	summary.quantiles = quantiles
+	summary.count += values.Count()
+	summary.sum += values.Sum() / float64(time.Second)
+}
+
+// serveMetrics runs http listener until service context is done
+func (s *Service) serveMetrics() {
+	server := &http.Server{
+		Addr:              s.metricsAddr,
+		Handler:           s.MetricsHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-s.ctx.Done()
+		server.Close()
+	}()
+	s.l.Info("starting metrics listener", slog.String("addr", s.metricsAddr))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.l.Error("metrics listener failed", err, slog.String("addr", s.metricsAddr))
+	}
+}
+
+func (s *Service) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := bufio.NewWriter(w)
+		s.writeMetrics(buf)
+		buf.Flush()
+	})
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.Connections()); err != nil {
+			s.l.Error("failed to write connection table", err)
+		}
+	})
+	return mux
+}
+
+func (s *Service) writeMetrics(w *bufio.Writer) {
+	var matchedMiners, connections int
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		matchedMiners += len(sh.matchedMiners)
+		connections += len(sh.connections)
+		sh.mu.Unlock()
+	}
+
+	writeMetric(w, "tcpmeasurer_files_parsed_total", "counter", "Capture files processed.", s.metrics.filesParsed.Load())
+	writeMetric(w, "tcpmeasurer_file_parse_errors_total", "counter", "Capture files which failed to parse.", s.metrics.parseErrors.Load())
+	writeMetric(w, "tcpmeasurer_capture_restarts_total", "counter", "Restarts of the capture process.", s.metrics.captureRestarts.Load())
+	writeMetric(w, "tcpmeasurer_unmatched_acks_total", "counter", "Miner ACKs without stratum response to match.", s.metrics.unmatchedACKs.Load())
+	writeMetric(w, "tcpmeasurer_latency_samples_total", "counter", "Latency samples matched, including open windows.", s.metrics.latencySamples.Load())
+	writeMetric(w, "tcpmeasurer_processing_samples_total", "counter", "Submits matched with stratum response, including open windows.", s.metrics.processingSamples.Load())
+	writeMetric(w, "tcpmeasurer_timestamp_samples_total", "counter", "RTT samples by TCP timestamps, including open windows.", s.metrics.timestampSamples.Load())
+	writeMetric(w, "tcpmeasurer_handshakes_total", "counter", "Completed handshakes of miner connections.", s.metrics.handshakes.Load())
+	writeMetric(w, "tcpmeasurer_half_open_handshakes_total", "counter", "Handshakes which are not completed in 30 seconds by event time.", s.metrics.halfOpen.Load())
+	writeMetric(w, "tcpmeasurer_notify_deliveries_total", "counter", "Miner ACKs of mining.notify, including open windows.", s.metrics.notifyDeliveries.Load())
+	writeMetric(w, "tcpmeasurer_late_samples_dropped_total", "counter", "Latency samples dropped because the window is already closed.", s.metrics.lateSamples.Load())
+	writeMetric(w, "tcpmeasurer_matched_miners", "gauge", "Miner connections mapped to worker group.", uint64(matchedMiners))
+	writeMetric(w, "tcpmeasurer_connections", "gauge", "Miner connections in the connection table, closed ones are kept until their window is written.", uint64(connections))
+	writeMetric(w, "tcpmeasurer_idle_connections_evicted_total", "counter", "Miner connections evicted by idle timeout without RST or FIN.", s.metrics.idleConnections.Load())
+	writeMetric(w, "tcpmeasurer_hosts_evicted_total", "counter", "Least recently seen miner connections evicted over the connection table limit.", s.metrics.hostsEvicted.Load())
+	writeMetric(w, "tcpmeasurer_entries_evicted_total", "counter", "Oldest segments, submits and timestamps of the miner evicted over the per host limit.", s.metrics.entriesEvicted.Load())
+	writeMetric(w, "tcpmeasurer_stale_entries_dropped_total", "counter", "Segments, submits and timestamps of the miner dropped without match after the idle age.", s.metrics.staleEntries.Load())
+
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	writeSummary(w, "tcpmeasurer_miner_latency_seconds", "Latency between stratum response and miner ACK, quantiles are for the last closed window.", s.metrics.latency)
+	writeSummary(w, "tcpmeasurer_submit_processing_seconds", "Time between mining.submit and stratum response, quantiles are for the last closed window.", s.metrics.processing)
+	writeSummary(w, "tcpmeasurer_timestamp_rtt_seconds", "RTT by TCP timestamps of the stratum echoed by the miner, quantiles are for the last closed window.", s.metrics.timestamps)
+	writeSummary(w, "tcpmeasurer_handshake_rtt_seconds", "Time between SYN-ACK of the stratum and ACK of the miner, quantiles are for the last closed window.", s.metrics.handshake)
+	writeSummary(w, "tcpmeasurer_notify_delivery_seconds", "Time between the first mining.notify of the job and miner ACK, quantiles are for the last closed window.", s.metrics.delivery)
+	writeSummary(w, "tcpmeasurer_notify_spread_seconds", "Time between the first and the last miner ACK of the job in the worker group, quantiles are for the last closed window.", s.metrics.spread)
+
+	const sharesName = "tcpmeasurer_shares_total"
+	fmt.Fprintf(w, "# HELP %s Submits by stratum response of closed windows, result is accepted, stale or reject reason.\n", sharesName)
+	fmt.Fprintf(w, "# TYPE %s counter\n", sharesName)
+	for _, l := range sortedLabels(s.metrics.shares) {
+		for r, count := range s.metrics.shares[l] {
+			fmt.Fprintf(w, "%s{%s,result=\"%s\"} %d\n", sharesName, l.String(), shareResult(r), count)
+		}
+	}
+
+	const eventsName = "tcpmeasurer_tcp_events_total"
+	fmt.Fprintf(w, "# HELP %s TCP events of miner connections of closed windows: stratum segments, retransmits, miner ACKs, duplicate ACKs, RST and FIN.\n", eventsName)
+	fmt.Fprintf(w, "# TYPE %s counter\n", eventsName)
+	for _, l := range sortedLabels(s.metrics.events) {
+		for e, count := range s.metrics.events[l] {
+			fmt.Fprintf(w, "%s{%s,event=\"%s\"} %d\n", eventsName, l.String(), tcpEvent(e), count)
+		}
+	}
+}
+
+// sortedLabels makes output stable
+func sortedLabels[T any](values map[latencyLabels]T) []latencyLabels {
+	labels := make([]latencyLabels, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, func(a, b latencyLabels) int {
+		return strings.Compare(a.workerGroup+"\x00"+a.coin, b.workerGroup+"\x00"+b.coin)
+	})
+	return labels
+}
+
+func (l latencyLabels) String() string {
+	return fmt.Sprintf(`worker_group="%s",coin="%s"`, escapeLabel(l.workerGroup), escapeLabel(l.coin))
+}
+
+func writeSummary(w *bufio.Writer, name, help string, summaries map[latencyLabels]*latencySummary) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for _, l := range sortedLabels(summaries) {
+		summary := summaries[l]
+		labelStr := l.String()
+		for i, q := range latencyQuantiles {
+			fmt.Fprintf(w, "%s{%s,quantile=\"%g\"} %g\n", name, labelStr, q, summary.quantiles[i])
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labelStr, summary.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, labelStr, summary.count)
+	}
+}
+
+func writeMetric(w *bufio.Writer, name, kind, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
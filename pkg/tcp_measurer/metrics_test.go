@@ -0,0 +1,133 @@
+package tcpmeasurer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/phayes/freeport"
+	"github.com/stretchr/testify/require"
+)
+
+func scrapeMetrics(t *testing.T, addr string) string {
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestService_Metrics(t *testing.T) {
+	// given
+	filesPath := t.TempDir()
+	fixture, err := os.ReadFile("samples/fixture-sll.pcap")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(filesPath, "caapture-0-broken.pcap"), []byte("not a pcap file"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(filesPath, "caapture-1.pcap"), fixture, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(filesPath, "caapture-2.pcap"), nil, 0o600)) // file which tcpdump is writing now
+	port, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	srv := newTestService(t,
+		WithSkipCMD("1"),
+		WithFilesPath(filesPath),
+		WithParseFilesInterval(50*time.Millisecond),
+		WithMetricsAddr(addr),
+	)
+	defer srv.Stop()
+
+	// when
+	require.NoError(t, srv.Start())
+	require.Eventually(t, func() bool {
+		return srv.metrics.filesParsed.Load() == 1
+	}, 3*time.Second, 50*time.Millisecond)
+	srv.observeEventTime(time.Date(2024, 5, 31, 13, 46, 0, 0, time.UTC)) // closes 13:40 window
+	srv.DumpIt()
+
+	// then
+	require.Eventually(t, func() bool {
+		resp, errG := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+		if errG == nil {
+			resp.Body.Close()
+		}
+		return errG == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	body := scrapeMetrics(t, addr)
+	for _, line := range []string{
+		"# TYPE tcpmeasurer_files_parsed_total counter",
+		"tcpmeasurer_files_parsed_total 1",
+		"tcpmeasurer_file_parse_errors_total 1",
+		"tcpmeasurer_capture_restarts_total 0",
+		"tcpmeasurer_latency_samples_total 24",
+		"tcpmeasurer_processing_samples_total 24",
+		"tcpmeasurer_matched_miners 3",
+		"# TYPE tcpmeasurer_miner_latency_seconds summary",
+		`tcpmeasurer_miner_latency_seconds_count{worker_group="lp-wg3-s19jpro.cos-pb11-r4a2-96",coin="BSV"} 7`,
+		`tcpmeasurer_miner_latency_seconds_count{worker_group="lp-wg5-s19jpro.cos-pb13-r1f6-100",coin="BSV"} 8`,
+		`tcpmeasurer_miner_latency_seconds_count{worker_group="sfm-wg3-m30s++.CA040A00098F",coin="BSV"} 9`, // ACK comes with the next submit
+		"# TYPE tcpmeasurer_submit_processing_seconds summary",
+		`tcpmeasurer_submit_processing_seconds_count{worker_group="sfm-wg3-m30s++.CA040A00098F",coin="BSV"} 9`,
+	} {
+		require.Contains(t, body, line+"\n")
+	}
+	require.Contains(t, body, "tcpmeasurer_unmatched_acks_total ")
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, `tcpmeasurer_miner_latency_seconds{worker_group="lp-wg3-s19jpro.cos-pb11-r4a2-96",coin="BSV",quantile="0.5"}`) {
+			var median float64
+			_, err = fmt.Sscanf(line[strings.LastIndex(line, " ")+1:], "%g", &median)
+			require.NoError(t, err)
+			require.InDelta(t, 0.0325, median, 0.001) // samples are in 32.0..33.0ms
+		}
+	}
+
+	srv.Stop()
+	require.Eventually(t, func() bool {
+		resp, errG := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+		if errG == nil {
+			resp.Body.Close()
+		}
+		return errG != nil
+	}, 3*time.Second, 50*time.Millisecond, "listener should be closed with service context")
+}
+
+func TestMetrics_EscapeLabel(t *testing.T) {
+	srv := newTestService(t)
+	latency := newLatencySketch()
+	latency.Add(float64(40 * time.Millisecond))
+	srv.metrics.observeWindow("wg\"1\\\n", "BSV", latency)
+	srv.metrics.observeWindow("wg\"1\\\n", "BSV", latency)
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	body := recorder.Body.String()
+	require.Contains(t, body, `tcpmeasurer_miner_latency_seconds_count{worker_group="wg\"1\\\n",coin="BSV"} 2`+"\n")
+	require.Contains(t, body, `tcpmeasurer_miner_latency_seconds_sum{worker_group="wg\"1\\\n",coin="BSV"} 0.08`+"\n")
+}
+
+func TestService_RunWithRestarts(t *testing.T) {
+	srv := newTestService(t)
+	srv.restartDelay = time.Millisecond
+
+	runs := 0
+	err := srv.runWithRestarts(func() error {
+		runs++
+		if runs == 3 {
+			srv.cancel() // CommandContext kills process on cancel
+			return errors.New("signal: killed")
+		}
+		return errors.New("exit status 1")
+	})
+	require.EqualError(t, err, "signal: killed")
+	require.Equal(t, 3, runs)
+	require.Equal(t, uint64(2), srv.metrics.captureRestarts.Load())
+}
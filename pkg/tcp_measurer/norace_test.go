@@ -0,0 +1,6 @@
+//go:build !race
+
+package tcpmeasurer
+
+// raceEnabled is true when tests are built with the race detector, sync.Pool drops items on purpose under it
+const raceEnabled = false
@@ -0,0 +1,126 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"orchestrator/common/pkg/sketch"
+	"orchestrator/common/pkg/utils"
+	"time"
+)
+
+// mining.notify propagation: stratum broadcasts the new job to every miner, miner ACK of the segment tells when the job is
+// received. Delivery is from the first notify of the job to the miner ACK, so it includes fan-out of the stratum.
+// Spread is from the first to the last ACK of the job by miners of the worker group.
+
+// notifySnapLen keeps job id of mining.notify, with default snap length it is cut
+const notifySnapLen = 256
+
+// WithNotifyPropagation enables measuring of mining.notify delivery, snap length is raised to capture job id
+func WithNotifyPropagation(enabled bool) Opt {
+	return func(s *Service) {
+		s.notifyPropagation = enabled
+		if enabled {
+			s.snapLen = max(s.snapLen, notifySnapLen)
+		}
+	}
+}
+
+type notifyJob struct {
+	id         string
+	sentAt     time.Time             // first mining.notify of the job to any miner
+	deliveries map[connKey]time.Time // targetHost -> miner ACK of the notify
+}
+
+type notifyStats struct {
+	jobs     uint64
+	delivery *sketch.DDSketch
+	spread   *sketch.DDSketch
+}
+
+// trackNotify registers jobs of mining.notify in the stratum payload and returns id of the last one, empty if there is none
+func (s *shard) trackNotify(eventTime time.Time, payload []byte) string {
+	if !s.notifyPropagation || !bytes.Contains(payload, []byte(stratumMethodNotify)) {
+		return ""
+	}
+	var (
+		msg   stratumMessage
+		jobID string
+	)
+	for rest := payload; len(rest) > 0; {
+		var ok bool
+		if rest, ok = nextStratumMessage(rest, &msg); !ok || !msg.isMethod(stratumMethodNotify) {
+			continue
+		}
+		job := msg.param(0)
+		if !job.isString() || len(job.raw) == 0 {
+			continue // cut by snap length, truncated id would merge different jobs
+		}
+		jobID = s.registerNotify(eventTime, job.raw)
+	}
+	return jobID
+}
+
+func (s *shard) registerNotify(eventTime time.Time, id []byte) string {
+	if job, ok := s.notifyJobs[string(id)]; ok {
+		if eventTime.Before(job.sentAt) {
+			job.sentAt = eventTime
+		}
+		return job.id
+	}
+	if s.windowClosed(utils.RoundToNearest5Minutes(eventTime), s.eventWatermark()) {
+		return ""
+	}
+	// every mapped miner of the shard may acknowledge the job, most shards see only a few of them
+	job := &notifyJob{id: string(id), sentAt: eventTime, deliveries: make(map[connKey]time.Time, len(s.matchedMiners))}
+	s.notifyJobs[job.id] = job
+	return job.id
+}
+
+// addDelivery saves miner ACK of the job, the first ACK of the miner is kept if notify is sent again
+func (s *shard) addDelivery(jobID string, targetHost connKey, ackAt time.Time) {
+	job, ok := s.notifyJobs[jobID]
+	if !ok {
+		s.metrics.lateSamples.Add(1) // window of the job is already written
+		return
+	}
+	if _, ok = job.deliveries[targetHost]; !ok {
+		job.deliveries[targetHost] = ackAt
+		s.metrics.notifyDeliveries.Add(1)
+	}
+}
+
+// aggregateNotify computes delivery and spread of jobs of the window by worker group
+func (s *Service) aggregateNotify(window bufferedWindow, minerCoin map[string]string) map[string]*notifyStats {
+	type firstLast struct {
+		first, last time.Time
+	}
+	aggregated := make(map[string]*notifyStats)
+	for _, job := range window.notify {
+		groups := make(map[string]*firstLast)
+		for targetHost, ackAt := range job.deliveries {
+			minerData := s.workerGroupCoin(window, targetHost, minerCoin)
+			if minerData == "" {
+				continue
+			}
+			if _, ok := aggregated[minerData]; !ok {
+				aggregated[minerData] = &notifyStats{delivery: newLatencySketch(), spread: newLatencySketch()}
+			}
+			aggregated[minerData].delivery.Add(float64(ackAt.Sub(job.sentAt)))
+			group, ok := groups[minerData]
+			if !ok {
+				groups[minerData] = &firstLast{first: ackAt, last: ackAt}
+				continue
+			}
+			if ackAt.Before(group.first) {
+				group.first = ackAt
+			}
+			if ackAt.After(group.last) {
+				group.last = ackAt
+			}
+		}
+		for minerData, group := range groups {
+			aggregated[minerData].jobs++
+			aggregated[minerData].spread.Add(float64(group.last.Sub(group.first)))
+		}
+	}
+	return aggregated
+}
@@ -0,0 +1,74 @@
+package tcpmeasurer
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testNotify = `{"id":null,"method":"mining.notify","params":["BSV-1","00","01","02",[],"20000000","1d00ffff","6659d4b4",true]}` + "\n"
+
+func TestService_NotifyPropagation(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithNotifyPropagation(true))
+	capture := newCapture(t)
+	proxied, other := netip.MustParseAddrPort("8.46.207.96:23914"), netip.MustParseAddrPort("8.46.207.97:23914")
+	miners := map[netip.AddrPort]string{
+		testMiner: "wg1.rig", // connections of the proxy share worker name
+		proxied:   "wg1.rig",
+		other:     "wg2.rig",
+	}
+	for miner, worker := range miners {
+		capture.send(captureStart, request(miner, 100, 1, `{"id":1,"method":"mining.authorize","params":["`+worker+`","x"]}`+"\n"))
+	}
+	notify := func(miner netip.AddrPort, after time.Duration, payload string) {
+		capture.send(captureStart.Add(after), reply(miner, 1, 200, payload))
+	}
+	confirm := func(miner netip.AddrPort, after time.Duration) {
+		capture.send(captureStart.Add(after), testSegment{src: miner, dst: testStratum, seq: 200, ack: 500, flags: tcpFlagACK})
+	}
+
+	// when
+	notify(testMiner, 0, testNotify)
+	notify(proxied, time.Millisecond, `{"id":null,"method":"mining.set_difficulty","params":[8192]}`+"\n"+testNotify)
+	notify(other, 2*time.Millisecond, testNotify)
+	confirm(testMiner, 10*time.Millisecond)
+	confirm(other, 32*time.Millisecond)
+	notify(proxied, 15*time.Millisecond, `{"id":5,"result":true,"error":null}`+"\n") // ACK acknowledges notify as well
+	confirm(proxied, 21*time.Millisecond)
+	notify(testMiner, time.Second, `{"id":null,"method":"mining.notify","params":["BSV-2`) // cut by snap length
+	confirm(testMiner, time.Second+10*time.Millisecond)
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	require.Len(t, sink.written(), 2)
+	wg1, wg2 := resultOf(t, sink, "wg1.rig"), resultOf(t, sink, "wg2.rig")
+	require.Equal(t, uint64(1), wg1.NotifyJobs)
+	require.InDelta(t, 21, wg1.NotifyDeliveryMax, 0.01, "delivery is from the first notify of the job")
+	require.InDelta(t, 11, wg1.NotifySpreadMax, 0.01)
+	require.Equal(t, uint64(1), wg2.NotifyJobs)
+	require.InDelta(t, 32, wg2.NotifyDeliveryMedian, 32*0.01)
+	require.Zero(t, wg2.NotifySpreadMax, "spread of single miner")
+	require.Contains(t, metricsText(t, srv), "tcpmeasurer_notify_deliveries_total 3\n")
+}
+
+func TestService_NotifyPropagation_Disabled(t *testing.T) {
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+	capture.send(captureStart, request(testMiner, 100, 1, `{"id":1,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n"))
+	capture.send(captureStart, reply(testMiner, 1, 200, testNotify))
+	capture.send(captureStart.Add(10*time.Millisecond), testSegment{src: testMiner, dst: testStratum, seq: 200, ack: 1 + uint32(len(testNotify)), flags: tcpFlagACK})
+	capture.replay(srv)
+
+	srv.Stop()
+
+	result := resultOf(t, sink, "wg1.rig")
+	require.Equal(t, uint64(1), result.Count, "notify is a stratum segment as any other")
+	require.Zero(t, result.NotifyJobs)
+	require.Contains(t, metricsText(t, srv), "tcpmeasurer_notify_deliveries_total 0\n")
+}
@@ -0,0 +1,295 @@
+package tcpmeasurer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// link types, see https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeLinuxSLL2 = 276
+)
+
+const (
+	etherTypeIPv4   = 0x0800
+	etherTypeIPv6   = 0x86dd
+	etherTypeVLAN   = 0x8100
+	etherTypeQinQ   = 0x88a8
+	etherTypeQinQv1 = 0x9100 // pre-standard QinQ
+
+	ipProtocolTCP = 6
+
+	// IPv6 extension headers
+	ipv6HopByHop     = 0
+	ipv6Routing      = 43
+	ipv6Fragment     = 44
+	ipv6AuthHeader   = 51
+	ipv6DestOptions  = 60
+	ipv6MaxExtHeader = 8 // protection from crafted chains
+)
+
+// TCPFlags is the second byte of the tcp flags field, flags are tested with bitwise and
+type TCPFlags uint8
+
+const (
+	tcpFlagFIN TCPFlags = 1 << iota
+	tcpFlagSYN
+	tcpFlagRST
+	tcpFlagPSH
+	tcpFlagACK
+	tcpFlagURG
+	tcpFlagECE
+	tcpFlagCWR
+)
+
+var tcpFlagNames = [8]string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+// String returns names of the set flags, e.g. `SYN|ACK`, it is for output only
+func (f TCPFlags) String() string {
+	var names []string
+	for i, name := range tcpFlagNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// tcp option kinds, see RFC 9293 and RFC 7323
+const (
+	tcpOptionEnd        = 0
+	tcpOptionNOP        = 1
+	tcpOptionTimestamps = 8
+	tcpOptionTSLen      = 10
+)
+
+var (
+	errShortFrame         = errors.New("frame is too short")
+	errUnsupportedPacket  = errors.New("unsupported packet")
+	errMalformedIPHeader  = errors.New("malformed ip header")
+	errMalformedTCPHeader = errors.New("malformed tcp header")
+)
+
+// tcpPacket is decoded tcp segment. All slices point to the frame memory.
+type tcpPacket struct {
+	srcIP      []byte // 4 bytes for IPv4, 16 bytes for IPv6
+	dstIP      []byte
+	srcPort    uint16
+	dstPort    uint16
+	seq        uint32
+	ack        uint32
+	flags      TCPFlags
+	window     uint16
+	payload    []byte // captured part of the payload, may be cut by snap length
+	payloadLen int    // payload length from ip header, it is used for sequence numbers
+	hasTS      bool   // timestamps option is present
+	tsVal      uint32
+	tsEcr      uint32
+}
+
+// decodePacket decodes link, network and transport layers of the frame.
+// Link layer defines where network header starts, ip header length and tcp data offset define where payload starts.
+func decodePacket(linkType uint16, frame []byte, pkt *tcpPacket) error {
+	etherType, offset, err := decodeLinkLayer(linkType, frame)
+	if err != nil {
+		return err
+	}
+	network := frame[offset:]
+	if etherType == 0 && len(network) > 0 {
+		// raw ip, protocol is defined by the version field
+		switch network[0] >> 4 {
+		case 4:
+			etherType = etherTypeIPv4
+		case 6:
+			etherType = etherTypeIPv6
+		}
+	}
+	switch etherType {
+	case etherTypeIPv4:
+		return decodeIPv4(network, pkt)
+	case etherTypeIPv6:
+		return decodeIPv6(network, pkt)
+	default:
+		return fmt.Errorf("%w: ethertype %#04x", errUnsupportedPacket, etherType)
+	}
+}
+
+// decodeLinkLayer returns protocol of the network layer and offset of the network header.
+// Zero protocol means that it should be guessed from the network header.
+func decodeLinkLayer(linkType uint16, frame []byte) (etherType uint16, offset int, err error) {
+	switch linkType {
+	case linkTypeEthernet:
+		offset = 14
+		if len(frame) < offset {
+			return 0, 0, errShortFrame
+		}
+		etherType = binary.BigEndian.Uint16(frame[12:14])
+	case linkTypeLinuxSLL:
+		offset = 16
+		if len(frame) < offset {
+			return 0, 0, errShortFrame
+		}
+		etherType = binary.BigEndian.Uint16(frame[14:16])
+	case linkTypeLinuxSLL2:
+		offset = 20
+		if len(frame) < offset {
+			return 0, 0, errShortFrame
+		}
+		etherType = binary.BigEndian.Uint16(frame[0:2])
+	case linkTypeRaw, linkTypeIPv4:
+		return 0, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: link type %d", errUnsupportedPacket, linkType)
+	}
+
+	// 802.1Q and QinQ tags: 2 bytes of tag control information and 2 bytes of the next ethertype
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeQinQv1 {
+		if len(frame) < offset+4 {
+			return 0, 0, errShortFrame
+		}
+		etherType = binary.BigEndian.Uint16(frame[offset+2 : offset+4])
+		offset += 4
+	}
+	return etherType, offset, nil
+}
+
+func decodeIPv4(data []byte, pkt *tcpPacket) error {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return errMalformedIPHeader
+	}
+	headerLen := int(data[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(data[2:4]))
+	if headerLen < 20 || len(data) < headerLen || totalLen < headerLen {
+		return errMalformedIPHeader
+	}
+	if data[9] != ipProtocolTCP {
+		return fmt.Errorf("%w: ip protocol %d", errUnsupportedPacket, data[9])
+	}
+	if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+		return fmt.Errorf("%w: ip fragment", errUnsupportedPacket)
+	}
+	pkt.srcIP = data[12:16]
+	pkt.dstIP = data[16:20]
+
+	// frame may be longer because of ethernet padding, or shorter because of snap length
+	segmentLen := totalLen - headerLen
+	segment := data[headerLen:]
+	if len(segment) > segmentLen {
+		segment = segment[:segmentLen]
+	}
+	return decodeTCP(segment, segmentLen, pkt)
+}
+
+func decodeIPv6(data []byte, pkt *tcpPacket) error {
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return errMalformedIPHeader
+	}
+	payloadLen := int(binary.BigEndian.Uint16(data[4:6]))
+	if payloadLen == 0 {
+		return fmt.Errorf("%w: ipv6 jumbogram", errUnsupportedPacket)
+	}
+	pkt.srcIP = data[8:24]
+	pkt.dstIP = data[24:40]
+
+	nextHeader, offset := data[6], 40
+	for i := 0; nextHeader != ipProtocolTCP; i++ {
+		if i == ipv6MaxExtHeader || len(data) < offset+8 {
+			return errMalformedIPHeader
+		}
+		var extLen int
+		switch nextHeader {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOptions:
+			extLen = (int(data[offset+1]) + 1) * 8
+		case ipv6AuthHeader:
+			extLen = (int(data[offset+1]) + 2) * 4
+		case ipv6Fragment:
+			if binary.BigEndian.Uint16(data[offset+2:offset+4])&0xfff8 != 0 {
+				return fmt.Errorf("%w: ip fragment", errUnsupportedPacket)
+			}
+			extLen = 8
+		default:
+			return fmt.Errorf("%w: ip protocol %d", errUnsupportedPacket, nextHeader)
+		}
+		nextHeader = data[offset]
+		offset += extLen
+	}
+	if offset-40 > payloadLen || len(data) < offset {
+		return errMalformedIPHeader
+	}
+
+	segmentLen := payloadLen - (offset - 40)
+	segment := data[offset:]
+	if len(segment) > segmentLen {
+		segment = segment[:segmentLen]
+	}
+	return decodeTCP(segment, segmentLen, pkt)
+}
+
+// decodeTCP decodes tcp header, segmentLen is the length of the segment before snap length was applied
+func decodeTCP(segment []byte, segmentLen int, pkt *tcpPacket) error {
+	if len(segment) < 20 {
+		return errMalformedTCPHeader
+	}
+	dataOffset := int(segment[12]>>4) * 4
+	if dataOffset < 20 || len(segment) < dataOffset || segmentLen < dataOffset {
+		return errMalformedTCPHeader
+	}
+	pkt.srcPort = binary.BigEndian.Uint16(segment[0:2])
+	pkt.dstPort = binary.BigEndian.Uint16(segment[2:4])
+	pkt.seq = binary.BigEndian.Uint32(segment[4:8])
+	pkt.ack = binary.BigEndian.Uint32(segment[8:12])
+	pkt.flags = TCPFlags(segment[13])
+	pkt.window = binary.BigEndian.Uint16(segment[14:16])
+	decodeTCPOptions(segment[20:dataOffset], pkt)
+	pkt.payload = segment[dataOffset:]
+	pkt.payloadLen = segmentLen - dataOffset
+	return nil
+}
+
+// decodeTCPOptions finds timestamps option, other options are skipped, malformed options are ignored
+func decodeTCPOptions(options []byte, pkt *tcpPacket) {
+	for len(options) > 0 {
+		switch options[0] {
+		case tcpOptionEnd:
+			return
+		case tcpOptionNOP:
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || options[1] < 2 || int(options[1]) > len(options) {
+			return
+		}
+		if options[0] == tcpOptionTimestamps && options[1] == tcpOptionTSLen {
+			pkt.hasTS = true
+			pkt.tsVal = binary.BigEndian.Uint32(options[2:6])
+			pkt.tsEcr = binary.BigEndian.Uint32(options[6:10])
+		}
+		options = options[options[1]:]
+	}
+}
+
+// clone copies the packet with its addresses and payload into buf, so the copy does not depend on memory of the source
+func (p *tcpPacket) clone(buf []byte) (tcpPacket, []byte) {
+	buf = append(append(append(buf[:0], p.srcIP...), p.dstIP...), p.payload...)
+	c := *p
+	src, dst := len(p.srcIP), len(p.srcIP)+len(p.dstIP)
+	c.srcIP, c.dstIP, c.payload = buf[:src:src], buf[src:dst:dst], buf[dst:]
+	return c, buf
+}
+
+func (p *tcpPacket) srcAddrPort() netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(p.srcIP)
+	return netip.AddrPortFrom(addr, p.srcPort)
+}
+
+func (p *tcpPacket) dstAddrPort() netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(p.dstIP)
+	return netip.AddrPortFrom(addr, p.dstPort)
+}
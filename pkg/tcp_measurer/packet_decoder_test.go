@@ -0,0 +1,285 @@
+package tcpmeasurer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"orchestrator/common/pkg/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodePacket(t *testing.T) {
+	response, response6 := testResponse(testStratum, testMiner), testResponse(testStratum6, testMiner6)
+	withOptions := response
+	withOptions.options = testTSOption
+	confirmation := testSegment{src: testStratum, dst: testMiner, seq: response.seq, ack: response.ack, flags: tcpFlagACK}
+	padded := buildEthernet(confirmation.ip())
+	padded = append(padded, make([]byte, 60-len(padded))...) // ethernet minimal frame size
+	truncated := buildSLL(withOptions.ip())
+	truncated = truncated[:len(truncated)-10] // snap length
+
+	type tCase struct {
+		linkType   uint16
+		frame      []byte
+		src        netip.AddrPort
+		dst        netip.AddrPort
+		flags      TCPFlags
+		window     uint16
+		payload    []byte
+		payloadLen int
+	}
+	data := func(linkType uint16, frame []byte) tCase {
+		return tCase{
+			linkType:   linkType,
+			frame:      frame,
+			src:        testStratum,
+			dst:        testMiner,
+			flags:      tcpFlagACK | tcpFlagPSH,
+			window:     502,
+			payload:    testPayload,
+			payloadLen: len(testPayload),
+		}
+	}
+	data6 := func(linkType uint16, frame []byte) tCase {
+		tc := data(linkType, frame)
+		tc.src, tc.dst = testStratum6, testMiner6
+		return tc
+	}
+	table := map[string]tCase{
+		"ethernet":                 data(linkTypeEthernet, buildEthernet(response.ip())),
+		"ethernet with 802.1Q tag": data(linkTypeEthernet, buildEthernet(response.ip(), etherTypeVLAN)),
+		"ethernet with QinQ tags":  data(linkTypeEthernet, buildEthernet(response.ip(), etherTypeQinQ, etherTypeVLAN)),
+		"ethernet padding is not a payload": {
+			linkType: linkTypeEthernet,
+			frame:    padded,
+			src:      testStratum,
+			dst:      testMiner,
+			flags:    tcpFlagACK,
+			payload:  []byte{},
+		},
+		"linux sll":           data(linkTypeLinuxSLL, buildSLL(response.ip())),
+		"linux sll2":          data(linkTypeLinuxSLL2, buildSLL2(response.ip())),
+		"raw ip":              data(linkTypeRaw, response.ip()),
+		"ipv4 link type":      data(linkTypeIPv4, response.ip()),
+		"ip and tcp options":  data(linkTypeLinuxSLL, buildSLL(buildIPv4(withOptions, []byte{1, 1, 1, 0}))),
+		"ipv6 ethernet":       data6(linkTypeEthernet, buildEthernet(response6.ip(), etherTypeVLAN)),
+		"ipv6 linux sll":      data6(linkTypeLinuxSLL, buildSLL(response6.ip())),
+		"ipv6 linux sll2":     data6(linkTypeLinuxSLL2, buildSLL2(response6.ip())),
+		"ipv6 raw ip":         data6(linkTypeRaw, response6.ip()),
+		"ipv6 hop-by-hop":     data6(linkTypeRaw, buildIPv6(response6, ipv6HopByHop)),
+		"ipv6 header chain":   data6(linkTypeRaw, buildIPv6(response6, ipv6HopByHop, ipv6Routing, ipv6Fragment, ipv6AuthHeader, ipv6DestOptions)),
+		"ipv6 first fragment": data6(linkTypeRaw, buildIPv6(response6, ipv6Fragment)),
+		"payload cut by snap length": {
+			linkType:   linkTypeLinuxSLL,
+			frame:      truncated,
+			src:        testStratum,
+			dst:        testMiner,
+			flags:      tcpFlagACK | tcpFlagPSH,
+			window:     502,
+			payload:    testPayload[:len(testPayload)-10],
+			payloadLen: len(testPayload),
+		},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			var pkt tcpPacket
+			require.NoError(t, decodePacket(tc.linkType, tc.frame, &pkt))
+			require.Equal(t, tc.src, pkt.srcAddrPort())
+			require.Equal(t, tc.dst, pkt.dstAddrPort())
+			require.Equal(t, uint32(3568706784), pkt.seq)
+			require.Equal(t, uint32(2396494875), pkt.ack)
+			require.Equal(t, tc.flags, pkt.flags)
+			require.Equal(t, tc.window, pkt.window)
+			require.Equal(t, tc.payload, pkt.payload)
+			require.Equal(t, tc.payloadLen, pkt.payloadLen)
+		})
+	}
+}
+
+func TestDecodePacket_Errors(t *testing.T) {
+	confirmation := testSegment{src: testMiner, dst: testStratum, flags: tcpFlagACK}
+	confirmation6 := testSegment{src: testMiner6, dst: testStratum6, flags: tcpFlagACK}
+	fragment := confirmation.ip()
+	binary.BigEndian.PutUint16(fragment[6:8], 10)
+	fragment6 := buildIPv6(confirmation6, ipv6Fragment)
+	binary.BigEndian.PutUint16(fragment6[42:44], 10<<3)
+	esp := buildIPv6(confirmation6, 50)
+	udp := confirmation.ip()
+	udp[9] = 17
+	badIHL := confirmation.ip()
+	badIHL[0] = 0x44
+	withOptions := confirmation
+	withOptions.options = testTSOption
+	badDataOffset := withOptions.ip()
+	badDataOffset[20+12] = 0xf0
+	badExtLen := buildIPv6(confirmation6, ipv6DestOptions)
+	badExtLen[41] = 20
+	longChain := buildIPv6(confirmation6, ipv6DestOptions, ipv6DestOptions, ipv6DestOptions, ipv6DestOptions,
+		ipv6DestOptions, ipv6DestOptions, ipv6DestOptions, ipv6DestOptions, ipv6DestOptions)
+
+	table := map[string]struct {
+		linkType uint16
+		frame    []byte
+		err      error
+	}{
+		"unsupported link type":         {linkType: 147, frame: confirmation.ip(), err: errUnsupportedPacket},
+		"short ethernet header":         {linkType: linkTypeEthernet, frame: make([]byte, 10), err: errShortFrame},
+		"short vlan tag":                {linkType: linkTypeEthernet, frame: buildEthernet(nil, etherTypeVLAN)[:16], err: errShortFrame},
+		"short sll header":              {linkType: linkTypeLinuxSLL, frame: make([]byte, 15), err: errShortFrame},
+		"short sll2 header":             {linkType: linkTypeLinuxSLL2, frame: make([]byte, 19), err: errShortFrame},
+		"not ip":                        {linkType: linkTypeEthernet, frame: append(make([]byte, 12), 0x08, 0x06), err: errUnsupportedPacket},
+		"udp":                           {linkType: linkTypeRaw, frame: udp, err: errUnsupportedPacket},
+		"ip fragment":                   {linkType: linkTypeRaw, frame: fragment, err: errUnsupportedPacket},
+		"short ip header":               {linkType: linkTypeIPv4, frame: confirmation.ip()[:19], err: errMalformedIPHeader},
+		"ip header length out of frame": {linkType: linkTypeRaw, frame: badIHL[:22], err: errMalformedIPHeader},
+		"short tcp header":              {linkType: linkTypeRaw, frame: confirmation.ip()[:30], err: errMalformedTCPHeader},
+		"tcp options out of segment":    {linkType: linkTypeRaw, frame: badDataOffset, err: errMalformedTCPHeader},
+		"short ipv6 header":             {linkType: linkTypeRaw, frame: confirmation6.ip()[:39], err: errMalformedIPHeader},
+		"ipv6 fragment":                 {linkType: linkTypeRaw, frame: fragment6, err: errUnsupportedPacket},
+		"ipv6 esp":                      {linkType: linkTypeRaw, frame: esp, err: errUnsupportedPacket},
+		"ipv6 extension out of packet":  {linkType: linkTypeRaw, frame: badExtLen, err: errMalformedIPHeader},
+		"ipv6 too many extensions":      {linkType: linkTypeRaw, frame: longChain, err: errMalformedIPHeader},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			var pkt tcpPacket
+			err := decodePacket(tc.linkType, tc.frame, &pkt)
+			require.True(t, errors.Is(err, tc.err), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestExtractTCPFlags(t *testing.T) {
+	flags, err := ExtractTCPFlags([]byte{0x50, 0x12})
+	require.NoError(t, err)
+	require.Equal(t, tcpFlagSYN|tcpFlagACK, flags)
+	require.Equal(t, "SYN|ACK", flags.String())
+	require.Equal(t, "FIN|SYN|RST|PSH|ACK|URG|ECE|CWR", TCPFlags(0xff).String())
+
+	_, err = ExtractTCPFlags([]byte{0x50})
+	require.Error(t, err)
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	response := testResponse(testStratum, testMiner)
+	response.options = testTSOption
+	frames := map[string]struct {
+		linkType uint16
+		frame    []byte
+	}{
+		"linux cooked ipv4":  {linkType: linkTypeLinuxSLL, frame: buildSLL(response.ip())},
+		"ethernet vlan ipv6": {linkType: linkTypeEthernet, frame: buildEthernet(testResponse(testStratum6, testMiner6).ip(), etherTypeVLAN)},
+	}
+	for name, tc := range frames {
+		b.Run(name, func(b *testing.B) {
+			var pkt tcpPacket
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := decodePacket(tc.linkType, tc.frame, &pkt); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	response := testResponse(testStratum, testMiner)
+	response.options = testTSOption
+	response6 := testResponse(testStratum6, testMiner6)
+	f.Add(uint16(linkTypeEthernet), buildEthernet(response.ip(), etherTypeQinQ, etherTypeVLAN))
+	f.Add(uint16(linkTypeLinuxSLL), buildSLL(buildIPv4(response, []byte{1, 1, 1, 0})))
+	f.Add(uint16(linkTypeLinuxSLL2), buildSLL2(response.ip()))
+	f.Add(uint16(linkTypeRaw), response.ip())
+	f.Add(uint16(linkTypeEthernet), buildEthernet(buildIPv6(response6, ipv6HopByHop, ipv6Fragment, ipv6AuthHeader)))
+	f.Fuzz(func(t *testing.T, linkType uint16, frame []byte) {
+		var pkt tcpPacket
+		if err := decodePacket(linkType, frame, &pkt); err != nil {
+			return
+		}
+		require.LessOrEqual(t, len(pkt.payload), pkt.payloadLen)
+		require.LessOrEqual(t, len(pkt.payload), len(frame))
+		require.Contains(t, []int{4, 16}, len(pkt.srcIP))
+		require.Len(t, pkt.dstIP, len(pkt.srcIP))
+	})
+}
+
+func TestService_ProcessFrame(t *testing.T) {
+	table := map[string]struct {
+		stratum netip.AddrPort
+		miner   netip.AddrPort
+	}{
+		"ipv4": {stratum: testStratum, miner: testMiner},
+		"ipv6": {stratum: testStratum6, miner: testMiner6},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			// given
+			srv := newTestService(t)
+			eventTime := time.Date(2024, 5, 31, 13, 43, 44, 0, time.UTC)
+			submit := testSegment{
+				src:     tc.miner,
+				dst:     tc.stratum,
+				seq:     2396494688,
+				ack:     3568706784,
+				flags:   tcpFlagACK | tcpFlagPSH,
+				payload: []byte(`{"params": ["lp-wg4-s19jpro.cos-pb12-r7b1-96", "BSV-846861-89d48", "00000000"], "id": 171118, "method": "mining.submit"}`),
+			}
+			response := testResponse(tc.stratum, tc.miner)
+			confirmation := testSegment{src: tc.miner, dst: tc.stratum, seq: response.ack, ack: response.seq + 41, flags: tcpFlagACK}
+
+			// when
+			replaySegments(t, srv, eventTime, submit)
+			replaySegments(t, srv, eventTime.Add(time.Millisecond), response)
+			replaySegments(t, srv, eventTime.Add(40*time.Millisecond+250*time.Microsecond), confirmation)
+
+			// then
+			key := connKey{miner: tc.miner, stratum: tc.stratum}
+			require.Equal(t, "lp-wg4-s19jpro.cos-pb12-r7b1-96", srv.shards[0].matchedMiners[key])
+			require.Equal(t, "BSV", srv.shards[0].matchedMinersCoin[key])
+			latency := srv.shards[0].buffer[utils.RoundToNearest5Minutes(eventTime)][key]
+			require.NotNil(t, latency)
+			require.Equal(t, uint64(1), latency.Count())
+			require.Equal(t, float64(39250*time.Microsecond), latency.Max())
+		})
+	}
+}
+
+func TestDecodeTCPOptions(t *testing.T) {
+	table := map[string]struct {
+		options []byte
+		hasTS   bool
+		tsVal   uint32
+		tsEcr   uint32
+	}{
+		"timestamps after nops": {options: testTSOption, hasTS: true, tsVal: 1, tsEcr: 2},
+		"syn options":           {options: []byte{2, 4, 5, 180, 4, 2, 8, 10, 0, 1, 0, 0, 0, 0, 0, 0, 1, 3, 3, 7}, hasTS: true, tsVal: 65536},
+		"sack before":           {options: []byte{1, 1, 5, 10, 0, 0, 0, 1, 0, 0, 0, 2, 8, 10, 0, 0, 0, 3, 0, 0, 0, 4}, hasTS: true, tsVal: 3, tsEcr: 4},
+		"no timestamps":         {options: []byte{2, 4, 5, 180, 1, 3, 3, 7, 0, 0}},
+		"after end of options":  {options: []byte{0, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}},
+		"bad length":            {options: []byte{8, 9, 0, 0, 0, 1, 0, 0, 0, 2, 1}},
+		"length out of options": {options: []byte{1, 8, 10, 0, 0, 0, 1, 0, 0, 0}},
+		"zero length":           {options: []byte{5, 0, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}},
+		"empty":                 {},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			var pkt tcpPacket
+			decodeTCPOptions(tc.options, &pkt)
+			require.Equal(t, tc.hasTS, pkt.hasTS)
+			require.Equal(t, tc.tsVal, pkt.tsVal)
+			require.Equal(t, tc.tsEcr, pkt.tsEcr)
+		})
+	}
+
+	seg := testResponse(testStratum, testMiner)
+	seg.options = testTSOption
+	var pkt tcpPacket
+	require.NoError(t, decodePacket(linkTypeRaw, seg.ip(), &pkt))
+	require.True(t, pkt.hasTS)
+	require.Equal(t, uint32(2), pkt.tsEcr)
+	require.Equal(t, testPayload, pkt.payload)
+}
@@ -0,0 +1,106 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// every capture is read by PacketSource which normalizes packets to tcpPacket, so pcap and pcapng files, live AF_PACKET
+// socket and gopacket handle of the local build are processed by the same dispatcher and state machine, see
+// processTCPPacket. Source decodes link, network and transport layers, the state machine does not know the capture format.
+
+// PacketHandler receives packets of the source in capture order, packet memory may be reused after the handler returns
+type PacketHandler func(eventTime time.Time, pkt *tcpPacket)
+
+// PacketSource is a capture of tcp packets
+type PacketSource interface {
+	// ReadPackets passes packets to the handler until the capture ends, packets which are not tcp are skipped
+	ReadPackets(handler PacketHandler) error
+	Close() error
+}
+
+// ReadSource processes packets of the source by shard workers, see dispatcher
+func (s *Service) ReadSource(src PacketSource) error {
+	d := s.newDispatcher()
+	defer d.close()
+	return src.ReadPackets(d.processPacket)
+}
+
+// decodeFrames adapts the handler to readers of captured frames
+func decodeFrames(handler PacketHandler) func(eventTime time.Time, linkType uint16, frame []byte) {
+	var pkt tcpPacket
+	return func(eventTime time.Time, linkType uint16, frame []byte) {
+		pkt = tcpPacket{}
+		if err := decodePacket(linkType, frame, &pkt); err != nil {
+			return
+		}
+		handler(eventTime, &pkt)
+	}
+}
+
+// fileSource reads pcap or pcapng file, format is detected by the magic number
+type fileSource struct {
+	file   *os.File
+	reader *bufio.Reader
+	read   func(r io.Reader, handler func(eventTime time.Time, linkType uint16, data []byte)) error // nil if file is empty
+}
+
+// NewFileSource opens pcap or pcapng capture file
+func NewFileSource(pcapFile string) (PacketSource, error) {
+	file, err := os.Open(pcapFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening pcap file: %w", err)
+	}
+	src := &fileSource{file: file, reader: bufio.NewReader(file), read: readPCAP}
+	magic, err := src.reader.Peek(4)
+	switch {
+	case len(magic) == 0 && errors.Is(err, io.EOF):
+		src.read = nil // nothing is written yet
+	case len(magic) == 4 && binary.LittleEndian.Uint32(magic) == pcapngSectionHeader:
+		src.read = readPCAPNG
+	}
+	return src, nil
+}
+
+func (f *fileSource) ReadPackets(handler PacketHandler) error {
+	if f.read == nil {
+		return nil
+	}
+	return f.read(f.reader, decodeFrames(handler))
+}
+
+func (f *fileSource) Close() error {
+	return f.file.Close()
+}
+
+// liveSource reads AF_PACKET socket until ctx is done
+type liveSource struct {
+	ctx      context.Context
+	capturer *Capturer
+}
+
+// NewLiveSource captures packets of the port on the interface, see Capturer
+func NewLiveSource(ctx context.Context, iface string, port uint64, snapLen int) (PacketSource, error) {
+	capturer, err := NewCapturer(iface, port, snapLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capturer: %w", err)
+	}
+	return &liveSource{ctx: ctx, capturer: capturer}, nil
+}
+
+func (l *liveSource) ReadPackets(handler PacketHandler) error {
+	decode := decodeFrames(handler)
+	return l.capturer.Run(l.ctx, func(eventTime time.Time, frame []byte) {
+		decode(eventTime, linkTypeRaw, frame) // cooked socket returns frames starting with ip header
+	})
+}
+
+func (l *liveSource) Close() error {
+	return l.capturer.Close()
+}
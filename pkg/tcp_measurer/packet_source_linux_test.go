@@ -0,0 +1,118 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const replayTimeout = 30 * time.Second
+
+func init() {
+	packetSources["live"] = openReplaySource
+}
+
+// replaySource sends frames of the capture file onto the loopback interface and reads them by the live source, so
+// packets are decoded from AF_PACKET socket. Kernel stamps frames with the replay time, the source passes them with
+// timestamps of the file in capture order, so window results are comparable with the file sources.
+type replaySource struct {
+	live    PacketSource
+	cancel  context.CancelFunc
+	packets [][]byte // network layer of the frames which pass the capture filter
+	times   []time.Time
+}
+
+// run as root or inside network namespace: `unshare -rn go test -run Conformance ./pkg/tcp_measurer/`
+func openReplaySource(t *testing.T, pcapFile string) PacketSource {
+	ctx, cancel := context.WithCancel(context.Background())
+	live, err := NewLiveSource(ctx, "lo", 3333, 65535)
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		cancel()
+		t.Skip("CAP_NET_RAW is required to open packet socket")
+	}
+	require.NoError(t, err)
+	r := &replaySource{live: live, cancel: cancel}
+
+	data, err := os.ReadFile(pcapFile)
+	require.NoError(t, err)
+	require.NoError(t, readPCAP(bytes.NewReader(data), func(eventTime time.Time, linkType uint16, frame []byte) {
+		var pkt tcpPacket
+		if decodePacket(linkType, frame, &pkt) != nil || pkt.srcPort != 3333 && pkt.dstPort != 3333 ||
+			pkt.flags&(tcpFlagSYN|tcpFlagACK|tcpFlagRST) == 0 {
+			return // it is dropped by the filter of the socket
+		}
+		_, offset, _ := decodeLinkLayer(linkType, frame)
+		r.packets = append(r.packets, bytes.Clone(frame[offset:]))
+		r.times = append(r.times, eventTime)
+	}))
+	return r
+}
+
+func (r *replaySource) ReadPackets(handler PacketHandler) error {
+	sent := make(chan error, 1)
+	go func() {
+		sent <- r.send()
+	}()
+	timeout := time.AfterFunc(replayTimeout, r.cancel)
+	defer timeout.Stop()
+
+	received := 0
+	err := r.live.ReadPackets(func(_ time.Time, pkt *tcpPacket) {
+		if received < len(r.times) {
+			handler(r.times[received], pkt)
+		}
+		if received++; received == len(r.times) {
+			r.cancel()
+		}
+	})
+	if errS := <-sent; errS != nil {
+		return errS
+	}
+	if err != nil {
+		return err
+	}
+	if received != len(r.times) {
+		return fmt.Errorf("received %d of %d packets", received, len(r.times))
+	}
+	return nil
+}
+
+// send writes packets to cooked socket of the loopback interface from one thread, so they are received in order
+func (r *replaySource) send() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return fmt.Errorf("failed to find loopback interface: %w", err)
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	for _, packet := range r.packets {
+		protocol := uint16(syscall.ETH_P_IP)
+		if packet[0]>>4 == 6 {
+			protocol = syscall.ETH_P_IPV6
+		}
+		addr := &syscall.SockaddrLinklayer{Protocol: htons(protocol), Ifindex: lo.Index, Halen: 6} // zero destination address
+		if err = syscall.Sendto(fd, packet, 0, addr); err != nil {
+			return fmt.Errorf("failed to send packet: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *replaySource) Close() error {
+	r.cancel()
+	return r.live.Close()
+}
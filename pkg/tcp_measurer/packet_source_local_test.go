@@ -0,0 +1,7 @@
+//go:build local
+
+package tcpmeasurer
+
+func init() {
+	packetSources["gopacket"] = opener(newGopacketSource)
+}
@@ -0,0 +1,149 @@
+package tcpmeasurer
+
+import (
+	"encoding/binary"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sourceFixtures are the same capture written in different formats, fixture-sll.pcap is the reference one
+var sourceFixtures = []string{
+	"samples/fixture-sll.pcap",
+	"samples/fixture-sll-usec-be.pcap",
+	"samples/fixture-sll-nsec.pcap",
+	"samples/fixture-sll-nsec-be.pcap",
+	"samples/fixture-sll-usec.pcapng",
+	"samples/fixture-sll-nsec-be.pcapng",
+}
+
+// packetSources opens every source of the capture file besides the file source which is the reference one: gopacket
+// source is added by the local build, live socket which reads the file replayed onto the loopback interface is added on
+// linux
+var packetSources = map[string]func(t *testing.T, pcapFile string) PacketSource{}
+
+func opener(open func(pcapFile string) (PacketSource, error)) func(t *testing.T, pcapFile string) PacketSource {
+	return func(t *testing.T, pcapFile string) PacketSource {
+		src, err := open(pcapFile)
+		require.NoError(t, err)
+		return src
+	}
+}
+
+func readSourceResults(t *testing.T, src PacketSource, shards int) [][]WindowResult {
+	t.Helper()
+	defer src.Close()
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithShards(shards))
+	require.NoError(t, srv.ReadSource(src))
+	srv.flushAll()
+	return sink.results
+}
+
+func checkPacketSources(t *testing.T, sources map[string]func(t *testing.T, pcapFile string) PacketSource, pcapFile string, expected [][]WindowResult) {
+	t.Helper()
+	for name, open := range sources {
+		t.Run(name+"/"+filepath.Base(pcapFile), func(t *testing.T) {
+			require.Equal(t, expected, readSourceResults(t, open(t, pcapFile), 1))
+			require.Equal(t, expected, readSourceResults(t, open(t, pcapFile), 4), "packets are copied before queued to shards")
+		})
+	}
+}
+
+// fragmentCapture is a submit acknowledged by the first ip fragment and non-first fragment which looks like an earlier
+// ACK, every source drops the non-first one as decodeIPv4 does
+func fragmentCapture() (frames, withoutFragment frameSource) {
+	at := time.Date(2024, 5, 31, 13, 41, 0, 0, time.UTC).Local() // file sources stamp packets in local time
+	submit := testSegment{
+		src:     testMiner,
+		dst:     testStratum,
+		seq:     2396494688,
+		ack:     3568706784,
+		flags:   tcpFlagACK | tcpFlagPSH,
+		window:  502,
+		payload: []byte(`{"params": ["lp-wg4-s19jpro.cos-pb12-r7b1-96", "BSV-846861-89d48", "00000000"], "id": 171118, "method": "mining.submit"}`),
+	}
+	confirmation := testSegment{src: testMiner, dst: testStratum, seq: 2396494875, ack: 3568706825, flags: tcpFlagACK, window: 502}
+	first := confirmation.ip()
+	binary.BigEndian.PutUint16(first[6:8], 0x2000) // more fragments
+	fragment := confirmation.ip()
+	binary.BigEndian.PutUint16(fragment[6:8], 10)
+
+	withoutFragment = frameSource{
+		{at: at, frame: buildSLL(submit.ip())},
+		{at: at.Add(time.Millisecond), frame: buildSLL(testResponse(testStratum, testMiner).ip())},
+		{at: at.Add(41 * time.Millisecond), frame: buildSLL(first)},
+	}
+	frames = append(slices.Clone(withoutFragment[:2]), testFrame{at: at.Add(5 * time.Millisecond), frame: buildSLL(fragment)}, withoutFragment[2])
+	return frames, withoutFragment
+}
+
+func TestPacketSource_Conformance(t *testing.T) {
+	samples, err := filepath.Glob("samples/caapture-*.pcap")
+	require.NoError(t, err)
+	require.NotEmpty(t, samples)
+
+	for _, sample := range samples {
+		expected := readSourceResults(t, opener(NewFileSource)(t, sample), 1)
+		require.NotEmpty(t, expected, sample)
+		t.Run("shards/"+filepath.Base(sample), func(t *testing.T) {
+			require.Equal(t, expected, readSourceResults(t, opener(NewFileSource)(t, sample), 4), "packets are copied before queued to shards")
+		})
+		checkPacketSources(t, packetSources, sample, expected)
+	}
+
+	// results of the capture with fragments do not depend on the file source, so it is checked as well
+	frames, withoutFragment := fragmentCapture()
+	expected := readSourceResults(t, withoutFragment, 1)
+	require.Len(t, expected, 1)
+	require.Len(t, expected[0], 1)
+	require.Equal(t, uint64(1), expected[0][0].Count, "only the first fragment acknowledges the response")
+	sources := maps.Clone(packetSources)
+	sources["pure go"] = opener(NewFileSource)
+	checkPacketSources(t, sources, writeCapture(t, frames), expected)
+}
+
+func TestPacketSource_Formats(t *testing.T) {
+	expected := readSourceResults(t, opener(NewFileSource)(t, sourceFixtures[0]), 1)
+	require.NotEmpty(t, expected)
+
+	for _, file := range sourceFixtures[1:] {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			require.Equal(t, expected, readSourceResults(t, opener(NewFileSource)(t, file), 1))
+		})
+	}
+}
+
+func TestNewFileSource(t *testing.T) {
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewFileSource("samples/missing.pcap")
+		require.ErrorContains(t, err, "error opening pcap file")
+	})
+	t.Run("empty file", func(t *testing.T) {
+		empty := filepath.Join(t.TempDir(), "empty.pcap")
+		require.NoError(t, os.WriteFile(empty, nil, 0o600))
+		src, err := NewFileSource(empty)
+		require.NoError(t, err)
+		defer src.Close()
+		require.NoError(t, src.ReadPackets(func(time.Time, *tcpPacket) { t.Fatal("no packets expected") }))
+	})
+}
+
+func TestTCPPacket_Clone(t *testing.T) {
+	frame := buildSLL(testResponse(testStratum, testMiner).ip())
+	var pkt tcpPacket
+	require.NoError(t, decodePacket(linkTypeLinuxSLL, frame, &pkt))
+
+	c, buf := pkt.clone(make([]byte, 0, 8))
+	clear(frame) // source reuses frame memory
+
+	require.Equal(t, testMiner, c.dstAddrPort())
+	require.Equal(t, testStratum, c.srcAddrPort())
+	require.Equal(t, testPayload, c.payload)
+	require.Len(t, buf, 4+4+len(testPayload))
+}
@@ -3,10 +3,8 @@
 package tcpmeasurer
 
 import (
+	"encoding/binary"
 	"fmt"
-	"orchestrator/common/pkg/utils"
-	"strings"
-	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -17,12 +15,13 @@ import (
 // stratum exchange between miner is chunked into separate blocks
 // 1. Miner sends request to the Stratum, ACK and PSH is true, payload is not empty
 // 2. Stratum sends response to the Miner, ACK is true, PSH is true, payload is not empty
-// 3. Miner sends confirmation to the Stratum, ACK is true, PSH is false, payload is empty
+// 3. Miner sends confirmation to the Stratum, ACK is true, PSH is false, payload is empty,
+// ACK may cover several responses at once or come with the next request of the miner, see ack_matching.go
 // so p1 and p2 is just how fast stratum software works, while 2 and 3 is show latency between miner and stratum
 // sample output:
 // 1. seq: 2396494688, ack: 3568706784, 2024-05-31 15:43:44.967858, len: 60, ACK: true, PSH: true,  target: 172.29.54.141:3333
 //   - (mining.submit) {"id":171118,"method":"mining.submit","params":["workergroup"...]}
-//   - we actually expect than miner will put params as first part of json. if not - there will be missing data in chart
+//   - worker is taken from mining.authorize or mining.submit in any key order, see stratum.go
 //
 // 2. seq: 3568706784, ack: 2396494875, 2024-05-31 15:43:44.967947, len: 41, ACK: true, PSH: true,  target: 8.46.207.95:23914
 //   - {"id":171118,"result":true,"error":null}
@@ -32,110 +31,107 @@ import (
 // from all tcp dump requests we can extract 3 types of requests:
 // 1. first request from miner to stratum - we use to map miner host to the miner worker group, ignore in calculations
 // 2. second request from stratum to miner - source host is stratum, target is miner, ACK, PSH
-// 3. third request from miner to stratum - source host is miner, target is stratum, ACK, delta between 2nd request and 3rd request is latency
+// 3. third request from miner to stratum - source host is miner, target is stratum, ACK covers the response, delta between 2nd request and 3rd request is latency
 func (s *Service) ReadFile(pcapFile string) error {
+	src, err := newGopacketSource(pcapFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return s.ReadSource(src) // same state machine as ReadFilePureGO, see processTCPPacket
+}
+
+// gopacketSource reads pcap file by libpcap, layers are decoded by gopacket and normalized to tcpPacket
+type gopacketSource struct {
+	handle *pcap.Handle
+}
+
+func newGopacketSource(pcapFile string) (PacketSource, error) {
 	handle, err := pcap.OpenOffline(pcapFile)
 	if err != nil {
-		return fmt.Errorf("error opening pcap file: %w", err)
+		return nil, fmt.Errorf("error opening pcap file: %w", err)
 	}
-	defer handle.Close()
+	return &gopacketSource{handle: handle}, nil
+}
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+func (g *gopacketSource) ReadPackets(handler PacketHandler) error {
+	packetSource := gopacket.NewPacketSource(g.handle, g.handle.LinkType())
 	packetSource.NoCopy = true
 
 	for packet := range packetSource.Packets() {
-		mc := &MeasurerContainer{
-			EventTime: packet.Metadata().Timestamp,
+		var (
+			hs  tcpPacket
+			tcp *layers.TCP
+		)
+		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			tcp, _ = tcpLayer.(*layers.TCP)
 		}
-
+		ipPayloadLen := -1 // length of tcp segment before snap length
 		if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
 			ip, _ := ipLayer.(*layers.IPv4)
-			mc.RemoteHost = ip.DstIP.String()
-			mc.SenderHost = ip.SrcIP.String()
-		}
-
-		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-
-			mc.RemoteHost = fmt.Sprintf("%s:%d", mc.RemoteHost, tcp.DstPort)
-			mc.SenderHost = fmt.Sprintf("%s:%d", mc.SenderHost, tcp.SrcPort)
-
-			isIncoming := uint64(tcp.DstPort) == s.observePort
-			hasMinerIDPayload := len(tcp.BaseLayer.Payload) >= 60
-			dataTCP := tcp.ACK && tcp.PSH
-
-			key := mc.RemoteHost
-			if isIncoming {
-				key = mc.SenderHost
-			}
-
-			if isIncoming && dataTCP && hasMinerIDPayload {
-				// 1. first request from miner to stratum - we use to map miner host to the miner worker group, ignore in calculations
-				s.mu.RLock()
-				kh, _ := s.matchedMiners[key]
-				s.mu.RUnlock()
-				if kh != "" {
-					continue
-				}
-
-				// extract miner data if it confirmation and we don't know miner yet
-				if minerData, coinName := ExtractWorkerGroup(tcp.Payload); minerData != "" {
-					s.mu.RLock()
-					s.matchedMiners[key] = minerData
-					s.matchedMinersCoin[key] = coinName
-					s.mu.RUnlock()
-				} else {
-					payload := string(tcp.Payload)
-					if strings.Contains(payload, "mining.authorize") ||
-						strings.Contains(payload, "mining.subscribe") ||
-						strings.Contains(payload, "mining.suggest_difficulty") ||
-						strings.Contains(payload, "mining.configure") {
-						continue
-					}
-					// s.l.Error("error extracting miner data", fmt.Errorf("miner data not found in payload"), slog.String("payload", payload))
-				}
-				continue
+			if ip.FragOffset != 0 {
+				continue // non-first fragment has no tcp header, it is dropped as by decodeIPv4
 			}
-
-			if _, ok := s.dataSeq[key]; !ok {
-				s.dataSeq[key] = make(map[uint32]*MeasurerContainer, 5_000)
+			if tcp == nil && ip.Protocol == layers.IPProtocolTCP {
+				tcp = decodeFirstFragment(ip.Payload) // gopacket does not decode layers of fragments
 			}
-			if !isIncoming && dataTCP {
-				// 2. second request from stratum to miner - source host is stratum, target is miner, ACK, PSH
-				s.dataSeq[key][tcp.Ack] = mc
-				continue
+			hs.srcIP, hs.dstIP = ip.SrcIP.To4(), ip.DstIP.To4()
+			ipPayloadLen = int(ip.Length) - int(ip.IHL)*4
+		} else if ipLayer = packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+			// gopacket skips extension headers by itself
+			ip, _ := ipLayer.(*layers.IPv6)
+			hs.srcIP, hs.dstIP = ip.SrcIP.To16(), ip.DstIP.To16()
+			if ip.NextHeader == layers.IPProtocolTCP {
+				ipPayloadLen = int(ip.Length) // length of extension headers is not known otherwise
 			}
+		}
 
-			confirmationTCP := tcp.ACK && !tcp.PSH
-			if isIncoming && confirmationTCP {
-				// 3. third request from miner to stratum - source host is miner, target is stratum, ACK, delta between 2nd request and 3rd request is latency
-				req, ok := s.dataSeq[key][tcp.Seq]
-				if !ok {
-					continue // abandoned package
-				}
-				// we already have Start time, so just get latency and remove it from the map
-				diff := mc.EventTime.Sub(req.EventTime)
-				time5MinAggregated := utils.RoundToNearest5Minutes(mc.EventTime)
-				s.mu.Lock()
-				if _, ok = s.buffer[time5MinAggregated]; !ok {
-					s.buffer[time5MinAggregated] = make(map[string][]float64, 5_000)
-				}
-				if _, ok = s.buffer[time5MinAggregated][key]; !ok {
-					s.buffer[time5MinAggregated][key] = make([]float64, 0, 1_000)
-				}
-				s.buffer[time5MinAggregated][key] = append(s.buffer[time5MinAggregated][key], float64(diff.Milliseconds()))
-				s.mu.Unlock()
-				delete(s.dataSeq[key], tcp.Seq)
-
-				// sometimes packages are lost, so we need cleanup to avoid memory leak
-				dropBefore := time.Now().Add(-1 * time.Hour)
-				for k := range s.dataSeq[key] {
-					if s.dataSeq[key][k].EventTime.Before(dropBefore) {
-						delete(s.dataSeq[key], k)
-					}
-				}
+		if tcp == nil || hs.srcIP == nil {
+			continue
+		}
+		hs.srcPort, hs.dstPort = uint16(tcp.SrcPort), uint16(tcp.DstPort)
+		hs.seq, hs.ack, hs.window = tcp.Seq, tcp.Ack, tcp.Window
+		hs.payload, hs.payloadLen = tcp.Payload, len(tcp.Payload)
+		if ipPayloadLen >= 0 {
+			hs.payloadLen = ipPayloadLen - int(tcp.DataOffset)*4 // payload may be cut by snap length
+		}
+		if tcp.FIN {
+			hs.flags |= tcpFlagFIN
+		}
+		if tcp.SYN {
+			hs.flags |= tcpFlagSYN
+		}
+		if tcp.RST {
+			hs.flags |= tcpFlagRST
+		}
+		if tcp.PSH {
+			hs.flags |= tcpFlagPSH
+		}
+		if tcp.ACK {
+			hs.flags |= tcpFlagACK
+		}
+		for _, opt := range tcp.Options {
+			if opt.OptionType == layers.TCPOptionKindTimestamps && len(opt.OptionData) == 8 {
+				hs.hasTS = true
+				hs.tsVal = binary.BigEndian.Uint32(opt.OptionData[0:4])
+				hs.tsEcr = binary.BigEndian.Uint32(opt.OptionData[4:8])
 			}
 		}
+		handler(packet.Metadata().Timestamp, &hs)
+	}
+	return nil
+}
+
+// decodeFirstFragment decodes tcp header of the first ip fragment, it returns nil if the header is malformed
+func decodeFirstFragment(data []byte) *layers.TCP {
+	tcp := &layers.TCP{}
+	if err := tcp.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil
 	}
+	return tcp
+}
+
+func (g *gopacketSource) Close() error {
+	g.handle.Close()
 	return nil
 }
@@ -0,0 +1,167 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// pcapng block types and options, see https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+const (
+	pcapngSectionHeader        = 0x0A0D0D0A
+	pcapngInterfaceDescription = 0x00000001
+	pcapngPacket               = 0x00000002 // obsolete, still written by old tools
+	pcapngEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic       = 0x1A2B3C4D
+
+	pcapngOptionEnd      = 0
+	pcapngOptionTSResol  = 9
+	pcapngOptionTSOffset = 14
+
+	pcapngMaxBlockSize = 16 << 20
+)
+
+// pcapngInterface keeps per-interface settings from Interface Description Block
+type pcapngInterface struct {
+	linkType uint16
+	tsUnits  uint64 // timestamp units per second
+	tsOffset int64  // seconds to add to every timestamp
+}
+
+// readPCAPNG walks pcapng blocks and passes every captured packet to the handler with link type of its interface.
+// Every section may have own byte order and own set of interfaces.
+func readPCAPNG(r io.Reader, handler func(eventTime time.Time, linkType uint16, data []byte)) error {
+	reader := bufio.NewReader(r)
+	var (
+		order      binary.ByteOrder = binary.LittleEndian
+		interfaces []pcapngInterface
+		header     = make([]byte, 8)
+		body       = make([]byte, 0, 4096)
+	)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("error reading block header: %w", err)
+		}
+
+		blockType := order.Uint32(header[:4])
+		if blockType == pcapngSectionHeader {
+			// byte order of the section is known only after reading the magic, length should be decoded after that
+			magic, err := reader.Peek(4)
+			if err != nil {
+				return fmt.Errorf("error reading section header: %w", err)
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+				order = binary.BigEndian
+			default:
+				return fmt.Errorf("unknown byte order magic %x", magic)
+			}
+			interfaces = interfaces[:0]
+		}
+
+		blockLen := order.Uint32(header[4:8])
+		if blockLen < 12 || blockLen%4 != 0 || blockLen > pcapngMaxBlockSize {
+			return fmt.Errorf("invalid block length %d", blockLen)
+		}
+		if cap(body) < int(blockLen)-8 {
+			body = make([]byte, blockLen-8)
+		}
+		body = body[:blockLen-8]
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return fmt.Errorf("error reading block body: %w", err)
+		}
+		body = body[:len(body)-4] // trailing block length
+
+		switch blockType {
+		case pcapngInterfaceDescription:
+			iface, err := parsePCAPNGInterface(order, body)
+			if err != nil {
+				return err
+			}
+			interfaces = append(interfaces, iface)
+		case pcapngEnhancedPacket, pcapngPacket:
+			if len(body) < 20 {
+				return fmt.Errorf("packet block is too short: %d", len(body))
+			}
+			ifaceID := order.Uint32(body[0:4])
+			if blockType == pcapngPacket {
+				ifaceID = uint32(order.Uint16(body[0:2])) // obsolete block keeps drops counter in the second half
+			}
+			if int(ifaceID) >= len(interfaces) {
+				return fmt.Errorf("packet refers to unknown interface %d", ifaceID)
+			}
+			capLen := order.Uint32(body[12:16])
+			if uint64(capLen) > uint64(len(body)-20) {
+				return fmt.Errorf("captured length %d exceeds block length", capLen)
+			}
+			iface := interfaces[ifaceID]
+			ts := uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12]))
+			handler(iface.timestamp(ts), iface.linkType, body[20:20+capLen])
+		}
+	}
+}
+
+func parsePCAPNGInterface(order binary.ByteOrder, body []byte) (pcapngInterface, error) {
+	if len(body) < 8 {
+		return pcapngInterface{}, fmt.Errorf("interface description block is too short: %d", len(body))
+	}
+	iface := pcapngInterface{
+		linkType: order.Uint16(body[0:2]),
+		tsUnits:  1_000_000, // default resolution is microseconds
+	}
+	options := body[8:]
+	for len(options) >= 4 {
+		code, length := order.Uint16(options[0:2]), int(order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			break
+		}
+		value := options[4 : 4+length]
+		switch {
+		case code == pcapngOptionTSResol && length == 1:
+			units, err := tsResolutionUnits(value[0])
+			if err != nil {
+				return pcapngInterface{}, err
+			}
+			iface.tsUnits = units
+		case code == pcapngOptionTSOffset && length == 8:
+			iface.tsOffset = int64(order.Uint64(value))
+		}
+		options = options[4+(length+3)&^3:]
+	}
+	return iface, nil
+}
+
+// tsResolutionUnits decodes if_tsresol: highest bit set means power of 2, otherwise power of 10
+func tsResolutionUnits(resol byte) (uint64, error) {
+	exp := uint64(resol & 0x7f)
+	if resol&0x80 != 0 {
+		if exp > 63 {
+			return 0, fmt.Errorf("unsupported timestamp resolution 2^-%d", exp)
+		}
+		return 1 << exp, nil
+	}
+	if exp > 19 {
+		return 0, fmt.Errorf("unsupported timestamp resolution 10^-%d", exp)
+	}
+	units := uint64(1)
+	for i := uint64(0); i < exp; i++ {
+		units *= 10
+	}
+	return units, nil
+}
+
+func (i pcapngInterface) timestamp(ts uint64) time.Time {
+	sec, frac := ts/i.tsUnits, ts%i.tsUnits
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, i.tsUnits) // frac < tsUnits, so it never overflows
+	return time.Unix(int64(sec)+i.tsOffset, int64(nsec))
+}
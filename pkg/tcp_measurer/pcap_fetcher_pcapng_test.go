@@ -0,0 +1,95 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_ReadFilePureGO_PCAPNG(t *testing.T) {
+	// fixtures contain the same packets of 3 miners from caapture-20240531134340.pcap
+	expected := newTestService(t)
+	require.NoError(t, expected.ReadFilePureGO("samples/fixture-sll.pcap"))
+	require.Len(t, expected.shards[0].matchedMiners, 3)
+	require.NotEmpty(t, expected.shards[0].buffer)
+
+	t.Run("microsecond resolution", func(t *testing.T) {
+		srv := newTestService(t)
+		require.NoError(t, srv.ReadFilePureGO("samples/fixture-sll-usec.pcapng"))
+		require.Equal(t, expected.shards[0].matchedMiners, srv.shards[0].matchedMiners)
+		require.Equal(t, expected.shards[0].buffer, srv.shards[0].buffer)
+	})
+	t.Run("big endian section with nanosecond resolution", func(t *testing.T) {
+		srv := newTestService(t)
+		require.NoError(t, srv.ReadFilePureGO("samples/fixture-sll-nsec-be.pcapng"))
+		require.Equal(t, expected.shards[0].matchedMiners, srv.shards[0].matchedMiners)
+		require.Equal(t, expected.shards[0].buffer, srv.shards[0].buffer)
+	})
+	t.Run("interfaces with different link types", func(t *testing.T) {
+		// one miner is captured on ethernet interface with 2^-20 timestamp resolution
+		srv := newTestService(t)
+		require.NoError(t, srv.ReadFilePureGO("samples/fixture-multi-iface.pcapng"))
+		require.Equal(t, expected.shards[0].matchedMiners, srv.shards[0].matchedMiners)
+		for window := range expected.shards[0].buffer {
+			require.Len(t, srv.shards[0].buffer[window], len(expected.shards[0].buffer[window]))
+			for host := range expected.shards[0].buffer[window] {
+				require.Equal(t, expected.shards[0].buffer[window][host].Count(), srv.shards[0].buffer[window][host].Count())
+			}
+		}
+	})
+}
+
+func TestReadPCAPNG(t *testing.T) {
+	t.Run("packet timestamps and link types", func(t *testing.T) {
+		data, err := os.ReadFile("samples/fixture-multi-iface.pcapng")
+		require.NoError(t, err)
+		var (
+			first     time.Time
+			linkTypes = make(map[uint16]int)
+		)
+		require.NoError(t, readPCAPNG(bytes.NewReader(data), func(eventTime time.Time, linkType uint16, _ []byte) {
+			if first.IsZero() {
+				first = eventTime
+			}
+			linkTypes[linkType]++
+		}))
+		require.Equal(t, map[uint16]int{1: 27, 113: 45}, linkTypes)
+		require.Equal(t, "2024-05-31 13:43:41", first.UTC().Format(time.DateTime))
+	})
+	t.Run("truncated file", func(t *testing.T) {
+		data, err := os.ReadFile("samples/fixture-sll-usec.pcapng")
+		require.NoError(t, err)
+		require.Error(t, readPCAPNG(bytes.NewReader(data[:len(data)-10]), func(time.Time, uint16, []byte) {}))
+	})
+	t.Run("packet before interface description", func(t *testing.T) {
+		data, err := os.ReadFile("samples/fixture-sll-usec.pcapng")
+		require.NoError(t, err)
+		shbLen := int(data[4]) | int(data[5])<<8
+		idbLen := int(data[shbLen+4]) | int(data[shbLen+5])<<8
+		withoutIDB := append(append([]byte{}, data[:shbLen]...), data[shbLen+idbLen:]...)
+		require.ErrorContains(t, readPCAPNG(bytes.NewReader(withoutIDB), func(time.Time, uint16, []byte) {}), "unknown interface")
+	})
+}
+
+func TestPCAPNGInterface_Timestamp(t *testing.T) {
+	table := map[byte]uint64{
+		6:         1_716_212_345_123_456,
+		9:         1_716_212_345_123_456_789,
+		0x80 | 20: 1_716_212_345<<20 | 129_453, // 129453 / 2^20 = 0.123456764 sec
+	}
+	for resol, ts := range table {
+		units, err := tsResolutionUnits(resol)
+		require.NoError(t, err)
+		eventTime := pcapngInterface{tsUnits: units}.timestamp(ts)
+		require.Equal(t, int64(1_716_212_345), eventTime.Unix())
+		require.InDelta(t, 123_456_000, eventTime.Nanosecond(), 1000, "resolution %x", resol)
+	}
+
+	_, err := tsResolutionUnits(20)
+	require.Error(t, err)
+	eventTime := pcapngInterface{tsUnits: 1000, tsOffset: 10}.timestamp(1500)
+	require.Equal(t, time.Unix(11, 500_000_000), eventTime)
+}
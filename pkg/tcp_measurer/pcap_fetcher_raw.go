@@ -3,25 +3,31 @@ package tcpmeasurer
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"net"
-	"orchestrator/common/pkg/utils"
-	"os"
-	"strings"
 	"time"
 )
 
-// ReadFilePureGO reads pcap file and processes it
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d // written with --time-stamp-precision=nano
+	pcapHeaderLen         = 24
+	pcapRecordHeaderLen   = 16
+	pcapMaxRecordLen      = 256 << 10
+)
+
+// ReadFilePureGO reads pcap or pcapng file and processes it
 // stratum exchange between miner is chunked into separate blocks
 // 1. Miner sends request to the Stratum, ACK and PSH is true, payload is not empty
 // 2. Stratum sends response to the Miner, ACK is true, PSH is true, payload is not empty
-// 3. Miner sends confirmation to the Stratum, ACK is true, PSH is false, payload is empty
+// 3. Miner sends confirmation to the Stratum, ACK is true, PSH is false, payload is empty,
+// ACK may cover several responses at once or come with the next request of the miner, see ack_matching.go
 // so p1 and p2 is just how fast stratum software works, while 2 and 3 is show latency between miner and stratum
 // sample output:
 // 1. seq: 2396494688, ack: 3568706784, 2024-05-31 15:43:44.967858, len: 60, ACK: true, PSH: true,  target: 172.29.54.141:3333
 //   - (mining.submit) {"id":171118,"method":"mining.submit","params":["workergroup"...]}
-//   - we actually expect than miner will put params as first part of json. if not - there will be missing data in chart
+//   - worker is taken from mining.authorize or mining.submit in any key order, see stratum.go
 //
 // 2. seq: 3568706784, ack: 2396494875, 2024-05-31 15:43:44.967947, len: 41, ACK: true, PSH: true,  target: 8.46.207.95:23914
 //   - {"id":171118,"result":true,"error":null}
@@ -31,207 +37,109 @@ import (
 // from all tcp dump requests we can extract 3 types of requests:
 // 1. first request from miner to stratum - we use to map miner host to the miner worker group, ignore in calculations
 // 2. second request from stratum to miner - source host is stratum, target is miner, ACK, PSH
-// 3. third request from miner to stratum - source host is miner, target is stratum, ACK, delta between 2nd request and 3rd request is latency
+// 3. third request from miner to stratum - source host is miner, target is stratum, ACK covers the response, delta between 2nd request and 3rd request is latency
 func (s *Service) ReadFilePureGO(pcapFile string) error {
-	file, err := os.Open(pcapFile)
+	src, err := NewFileSource(pcapFile)
 	if err != nil {
-		return fmt.Errorf("error opening pcap file: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer src.Close()
+	return s.ReadSource(src)
+}
 
-	// Skip the global header
-	fileHeader := make([]byte, 24)
-	_, err = file.Read(fileHeader)
-	if err == io.EOF {
-		return nil
+// readPCAP reads classic libpcap file, byte order of the headers is defined by the magic number
+func readPCAP(r io.Reader, handler func(eventTime time.Time, linkType uint16, data []byte)) error {
+	fileHeader := make([]byte, pcapHeaderLen)
+	if _, err := io.ReadFull(r, fileHeader); err != nil {
+		return fmt.Errorf("error reading file header: %w", err)
 	}
+	order, tsUnit, err := pcapByteOrder(fileHeader[:4])
 	if err != nil {
-		return fmt.Errorf("error reading packet header: %w", err)
-	}
-
-	linkType := binary.BigEndian.Uint16(fileHeader[20:24])
-	// LINKTYPE_LINUX_SLL 113 - 18388
-	// LINKTYPE_LINUX_SLL2 276 - 7722
-	offset := 28
-	if linkType == 5121 {
-		offset = 32
+		return err
 	}
-	//file.Seek(24, io.SeekStart)
+	// upper bits of the field may keep FCS length, link type is in the lower 16 bits
+	linkType := uint16(order.Uint32(fileHeader[20:24]))
 
-	counter := 0
-	packetHeader := make([]byte, 16)
+	packetHeader := make([]byte, pcapRecordHeaderLen)
+	packetData := make([]byte, 0, 4096)
 	for {
-		counter++
-		_, err = file.Read(packetHeader)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
+		if _, err := io.ReadFull(r, packetHeader); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
 			return fmt.Errorf("error reading packet header: %w", err)
 		}
 
-		tsSec := binary.LittleEndian.Uint32(packetHeader[:4])
-		tsUSec := binary.LittleEndian.Uint32(packetHeader[4:8])
-		capLen := binary.LittleEndian.Uint32(packetHeader[8:12])
-		packetData := make([]byte, capLen)
-		if _, err = file.Read(packetData); err != nil {
-			return fmt.Errorf("error reading packet data: %w", err)
+		tsSec := order.Uint32(packetHeader[:4])
+		tsFrac := order.Uint32(packetHeader[4:8])
+		capLen := order.Uint32(packetHeader[8:12])
+		if capLen > pcapMaxRecordLen {
+			return fmt.Errorf("invalid captured length %d", capLen)
 		}
-		if len(packetData) < 48 {
-			continue
-		}
-
-		// packetData
-		// * Ethernet Header: 14 bytes
-		// * IPv4 Header: 20 bytes
-		//   - Source IP Address: 4 bytes
-		//   - Destination IP Address: 4 bytes
-		// * TCP Header: 20 bytes
-		mc := &MeasurerContainer{
-			EventTime:  time.Unix(int64(tsSec), int64(tsUSec)*1000),
-			SenderHost: net.IP(packetData[offset : offset+4]).String(),   // Source IP Address offset
-			RemoteHost: net.IP(packetData[offset+4 : offset+8]).String(), // Destination IP Address offset
+		if cap(packetData) < int(capLen) {
+			packetData = make([]byte, capLen)
 		}
-
-		srcPort := binary.BigEndian.Uint16(packetData[offset+8 : offset+8+2])
-		dstPort := binary.BigEndian.Uint16(packetData[offset+8+2 : offset+8+4])
-		mc.RemoteHost = fmt.Sprintf("%s:%d", mc.RemoteHost, dstPort)
-		mc.SenderHost = fmt.Sprintf("%s:%d", mc.SenderHost, srcPort)
-
-		seqOffset := offset + 12
-		seq := binary.BigEndian.Uint32(packetData[seqOffset : seqOffset+4])
-		ack := binary.BigEndian.Uint32(packetData[seqOffset+4 : seqOffset+8])
-
-		flagsOffset := seqOffset + 8
-		flags := packetData[flagsOffset : flagsOffset+2]
-
-		flagsMap, errFlag := ExtractTCPFlags(flags)
-		if errFlag != nil {
-			continue
+		packetData = packetData[:capLen]
+		if _, err := io.ReadFull(r, packetData); err != nil {
+			return fmt.Errorf("error reading packet data: %w", err)
 		}
-		flagACK := flagsMap["ACK"]
-		flagPSN := flagsMap["PSH"]
-		dataTCP := flagACK && flagPSN
-
-		isIncoming := uint64(dstPort) == s.observePort
+		handler(time.Unix(int64(tsSec), int64(tsFrac)*int64(tsUnit)), linkType, packetData)
+	}
+}
 
-		hasMinerIDPayload := false
-		payloadStarts := 0
-		for i := 48; i < len(packetData)-10; i++ {
-			if bytes.Equal(packetData[i:i+10], prefix) {
-				hasMinerIDPayload = true
-				payloadStarts = i
-				break
-			}
+// pcapByteOrder detects byte order of the file and resolution of the record timestamps from the magic number
+func pcapByteOrder(magic []byte) (binary.ByteOrder, time.Duration, error) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic) {
+		case pcapMagicMicroseconds:
+			return order, time.Microsecond, nil
+		case pcapMagicNanoseconds:
+			return order, time.Nanosecond, nil
 		}
+	}
+	return nil, 0, fmt.Errorf("unknown pcap magic %x", magic)
+}
 
-		//mc.SenderHost, mc.RemoteHost = parseIPv4Header(packetData[14 : 14+20])
-		//
-		//srcPort, dstPort, seq, ack, flags, payload := parseTCPHeader(packetData[34:])
-		//mc.RemoteHost = fmt.Sprintf("%s:%d", mc.RemoteHost, dstPort)
-		//mc.SenderHost = fmt.Sprintf("%s:%d", mc.SenderHost, srcPort)
-		//
-		//hasMinerIDPayload := len(payload) >= 60
-		//dataTCP = flags&(0x10|0x08) == (0x10 | 0x08) // ACK and PSH
+// processTCPPacket is called by the worker of the shard with s.mu held
+func (s *shard) processTCPPacket(eventTime time.Time, pkt *tcpPacket) {
+	isIncoming := uint64(pkt.dstPort) == s.observePort
+	key := connKey{miner: pkt.dstAddrPort(), stratum: pkt.srcAddrPort()}
+	if isIncoming {
+		key = connKey{miner: pkt.srcAddrPort(), stratum: pkt.dstAddrPort()}
+	}
 
-		key := mc.RemoteHost
-		if isIncoming {
-			key = mc.SenderHost
-		}
+	s.processTimestamps(eventTime, key, isIncoming, pkt)
+	retransmitted := s.processFlow(eventTime, key, isIncoming, pkt)
+	if s.processHandshake(eventTime, key, isIncoming, pkt) {
+		return
+	}
 
-		if isIncoming && hasMinerIDPayload {
+	if isIncoming {
+		if bytes.IndexByte(pkt.payload, '{') >= 0 {
 			// 1. first request from miner to stratum - we use to map miner host to the miner worker group, ignore in calculations
-			s.mu.RLock()
-			kh, _ := s.matchedMiners[key]
-			s.mu.RUnlock()
-			if kh != "" {
-				continue
-			}
-
-			// extract miner data if it confirmation and we don't know miner yet
-			if minerData, coinName := ExtractWorkerGroup(packetData[payloadStarts:]); minerData != "" {
-				s.mu.Lock()
-				s.matchedMiners[key] = minerData
-				s.matchedMinersCoin[key] = coinName
-				s.mu.Unlock()
-				if coinName == "" {
-					println(string(packetData[payloadStarts:]))
-				}
-			} else {
-				payloadStr := string(packetData[payloadStarts:])
-				if strings.Contains(payloadStr, "mining.authorize") ||
-					strings.Contains(payloadStr, "mining.subscribe") ||
-					strings.Contains(payloadStr, "mining.suggest_difficulty") ||
-					strings.Contains(payloadStr, "mining.configure") {
-					continue
-				}
-				// s.l.Error("error extracting miner data", fmt.Errorf("miner data not found in payload"), slog.String("payload", payloadStr))
-			}
-			continue
+			s.processMinerPayload(key, pkt.dstPort, eventTime, pkt.seq+uint32(pkt.payloadLen), pkt.payload)
 		}
-
-		s.dataMUSeq.Lock()
-		if _, ok := s.dataSeq[key]; !ok {
-			s.dataSeq[key] = make(map[uint32]*MeasurerContainer, 5000)
-		}
-		s.dataMUSeq.Unlock()
-
-		if !isIncoming && dataTCP {
-			// 2. second request from stratum to miner - source host is stratum, target is miner, ACK, PSH
-			s.dataMUSeq.Lock()
-			s.dataSeq[key][ack] = mc
-			s.dataMUSeq.Unlock()
-			continue
+		// 3. third request from miner to stratum - ACK which covers stratum segments, it may come with the data of the miner,
+		// delta between 2nd request and 3rd request is latency
+		if pkt.flags&tcpFlagACK != 0 && !s.resolveACK(eventTime, key, pkt.ack) && pkt.payloadLen == 0 {
+			s.metrics.unmatchedACKs.Add(1)
 		}
+		return
+	}
 
-		confirmationTCP := flagACK && !flagPSN //flags&0x10 == 0x10 && flags&0x08 == 0x00 // ACK and not PSH
-		if isIncoming && confirmationTCP {
-			// 3. third request from miner to stratum - source host is miner, target is stratum, ACK, delta between 2nd request and 3rd request is latency
-			s.dataMUSeq.Lock()
-			req, ok := s.dataSeq[key][seq]
-			s.dataMUSeq.Unlock()
-			if !ok {
-				continue // abandoned package
-			}
-			// we already have Start time, so just get latency and remove it from the map
-			diff := mc.EventTime.Sub(req.EventTime)
-			time5MinAggregated := utils.RoundToNearest5Minutes(mc.EventTime)
-			s.mu.Lock()
-			if _, ok = s.buffer[time5MinAggregated]; !ok {
-				s.buffer[time5MinAggregated] = make(map[string][]float64, 5000)
-			}
-			if _, ok = s.buffer[time5MinAggregated][key]; !ok {
-				s.buffer[time5MinAggregated][key] = make([]float64, 0, 1000)
-			}
-			s.buffer[time5MinAggregated][key] = append(s.buffer[time5MinAggregated][key], float64(diff.Milliseconds()))
-			s.mu.Unlock()
-			s.dataMUSeq.Lock()
-			delete(s.dataSeq[key], seq)
-			s.dataMUSeq.Unlock()
-		}
+	if pkt.payloadLen > 0 {
+		// 2. second request from stratum to miner - source host is stratum, target is miner, segment with data,
+		// PSH is not set on every segment of the long response
+		mc := MeasurerContainer{EventTime: eventTime, JobID: s.trackNotify(eventTime, pkt.payload), Retransmitted: retransmitted}
+		s.trackSegment(key, pkt.seq, pkt.seq+uint32(pkt.payloadLen), mc)
+		s.matchSubmitResponses(key, eventTime, pkt.ack, pkt.payload)
 	}
-	return nil
 }
 
-func ExtractTCPFlags(data []byte) (map[string]bool, error) {
+// ExtractTCPFlags returns flags of the 2 bytes flags field of the tcp header as bitmask
+func ExtractTCPFlags(data []byte) (TCPFlags, error) {
 	if len(data) < 2 {
-		return nil, fmt.Errorf("data slice must be at least 2 bytes")
+		return 0, fmt.Errorf("data slice must be at least 2 bytes")
 	}
-
-	// Extract the second byte, which contains the TCP flags
-	tcpFlags := data[1]
-
-	// Map of TCP flags
-	flags := map[string]bool{
-		"FIN": tcpFlags&0x01 != 0,
-		"SYN": tcpFlags&0x02 != 0,
-		"RST": tcpFlags&0x04 != 0,
-		"PSH": tcpFlags&0x08 != 0,
-		"ACK": tcpFlags&0x10 != 0,
-		"URG": tcpFlags&0x20 != 0,
-		"ECE": tcpFlags&0x40 != 0,
-		"CWR": tcpFlags&0x80 != 0,
-	}
-
-	return flags, nil
+	return TCPFlags(data[1]), nil
 }
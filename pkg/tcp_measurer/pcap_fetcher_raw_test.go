@@ -0,0 +1,136 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_ReadFilePureGO_PCAPVariants(t *testing.T) {
+	// fixtures contain the same packets, nanosecond ones are shifted by 321ns
+	expected := newTestService(t)
+	require.NoError(t, expected.ReadFilePureGO("samples/fixture-sll.pcap"))
+
+	table := map[string]struct {
+		file       string
+		nanosecond bool
+	}{
+		"big endian microseconds":    {file: "samples/fixture-sll-usec-be.pcap"},
+		"little endian nanoseconds":  {file: "samples/fixture-sll-nsec.pcap", nanosecond: true},
+		"big endian nanoseconds":     {file: "samples/fixture-sll-nsec-be.pcap", nanosecond: true},
+		"little endian microseconds": {file: "samples/fixture-sll.pcap"},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			srv := newTestService(t)
+			require.NoError(t, srv.ReadFilePureGO(tc.file))
+			require.Equal(t, expected.shards[0].matchedMiners, srv.shards[0].matchedMiners)
+			require.Equal(t, expected.shards[0].buffer, srv.shards[0].buffer)
+
+			// event time keeps the precision of the file
+			if tc.nanosecond {
+				require.Equal(t, 321, srv.eventWatermark().Nanosecond()%1000)
+			} else {
+				require.Zero(t, srv.eventWatermark().Nanosecond()%1000)
+			}
+		})
+	}
+}
+
+func TestReadPCAP(t *testing.T) {
+	t.Run("record timestamps", func(t *testing.T) {
+		table := map[string]time.Time{
+			"samples/fixture-sll.pcap":         time.Unix(1717163021, 129501000),
+			"samples/fixture-sll-usec-be.pcap": time.Unix(1717163021, 129501000),
+			"samples/fixture-sll-nsec.pcap":    time.Unix(1717163021, 129501321),
+			"samples/fixture-sll-nsec-be.pcap": time.Unix(1717163021, 129501321),
+		}
+		for file, first := range table {
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			var (
+				timestamps []time.Time
+				linkTypes  = make(map[uint16]int)
+			)
+			require.NoError(t, readPCAP(bytes.NewReader(data), func(eventTime time.Time, linkType uint16, _ []byte) {
+				timestamps = append(timestamps, eventTime)
+				linkTypes[linkType]++
+			}))
+			require.Equal(t, map[uint16]int{linkTypeLinuxSLL: 72}, linkTypes, file)
+			require.True(t, first.Equal(timestamps[0]), "%s: %s", file, timestamps[0])
+		}
+	})
+	t.Run("unknown magic", func(t *testing.T) {
+		data, err := os.ReadFile("samples/fixture-sll.pcap")
+		require.NoError(t, err)
+		data[0] = 0
+		require.ErrorContains(t, readPCAP(bytes.NewReader(data), func(time.Time, uint16, []byte) {}), "unknown pcap magic")
+	})
+	t.Run("truncated file", func(t *testing.T) {
+		data, err := os.ReadFile("samples/fixture-sll-nsec-be.pcap")
+		require.NoError(t, err)
+		require.Error(t, readPCAP(bytes.NewReader(data[:len(data)-10]), func(time.Time, uint16, []byte) {}))
+	})
+}
+
+// exchangeReplay passes i-th exchange of stratum response and miner ACK of it to the handler, frames are built once and
+// patched in place with sequence numbers of the exchange, so every exchange gives a latency sample
+func exchangeReplay(handler func(eventTime time.Time, linkType uint16, frame []byte)) func(i int) {
+	const tcpOffset = 16 + 20 // linux cooked header and ipv4 header
+	response := testResponse(testStratum, testMiner)
+	ack := testSegment{src: testMiner, dst: testStratum, seq: response.ack, flags: tcpFlagACK, window: 502}
+	responseFrame, ackFrame := buildSLL(response.ip()), buildSLL(ack.ip())
+	at := time.Date(2024, 5, 31, 13, 40, 0, 0, time.UTC)
+	return func(i int) {
+		seq := response.seq + uint32(i*len(testPayload))
+		binary.BigEndian.PutUint32(responseFrame[tcpOffset+4:], seq)
+		binary.BigEndian.PutUint32(ackFrame[tcpOffset+8:], seq+uint32(len(testPayload)))
+		sentAt := at.Add(time.Duration(i) * 40 * time.Millisecond)
+		handler(sentAt, linkTypeLinuxSLL, responseFrame)
+		handler(sentAt.Add(30*time.Millisecond), linkTypeLinuxSLL, ackFrame)
+	}
+}
+
+func TestDispatcher_ProcessFrame_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("packet buffers of the pool are dropped by the race detector")
+	}
+	srv := newTestService(t)
+	d := srv.newDispatcher()
+	replay := exchangeReplay(decodeFrames(d.processPacket))
+	replay(0) // connection, window and sketch of the miner are created
+	next := 1
+	for ; next <= shardQueueLen; next++ { // buffers of packets queued to the shard are taken from the pool
+		replay(next)
+	}
+	d.drain()
+	allocs := testing.AllocsPerRun(1000, func() {
+		replay(next)
+		next++
+	})
+	d.close()
+	require.Zero(t, allocs)
+	require.Equal(t, uint64(next), srv.metrics.latencySamples.Load())
+}
+
+func BenchmarkDispatcher_ProcessFrame(b *testing.B) {
+	for _, shards := range []int{1, 2} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			srv := newTestService(b, WithShards(shards))
+			d := srv.newDispatcher()
+			defer d.close()
+			replay := exchangeReplay(decodeFrames(d.processPacket))
+			replay(0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 1; i <= b.N; i++ {
+				replay(i)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"time"
+)
+
+// pool processing time is measured from mining.submit of the miner to the stratum response with the same JSON-RPC id.
+// Submit which is cut by snap length before id is matched by tcp: response acknowledges the whole submit.
+
+// trackSubmit remembers time of mining.submit
+func (s *shard) trackSubmit(key connKey, eventTime time.Time, nextSeq uint32, msg *stratumMessage) {
+	switch {
+	case msg.isMethod(stratumMethodSubmit) && msg.hasID():
+		if _, ok := s.submits[key]; !ok {
+			s.submits[key] = make(map[string]time.Time, 16)
+		}
+		if makeRoom(s.submits[key], string(msg.id.raw), s.maxHostEntries, timeOf) {
+			s.metrics.entriesEvicted.Add(1)
+		}
+		s.submits[key][string(msg.id.raw)] = eventTime
+	case msg.truncated && !msg.hasID() && (msg.isMethod(stratumMethodSubmit) || msg.method.raw == nil && msg.jobID() != nil):
+		if _, ok := s.submitsSeq[key]; !ok {
+			s.submitsSeq[key] = make(map[uint32]time.Time, 16)
+		}
+		if makeRoom(s.submitsSeq[key], nextSeq, s.maxHostEntries, timeOf) {
+			s.metrics.entriesEvicted.Add(1)
+		}
+		s.submitsSeq[key][nextSeq] = eventTime
+	}
+}
+
+// matchSubmitResponses finds submits of stratum responses in the payload and counts their results,
+// ack is acknowledgment number of the segment
+func (s *shard) matchSubmitResponses(key connKey, eventTime time.Time, ack uint32, payload []byte) {
+	if bytes.IndexByte(payload, '{') < 0 {
+		return
+	}
+	var msg stratumMessage
+	for rest := payload; len(rest) > 0; {
+		var ok bool
+		if rest, ok = nextStratumMessage(rest, &msg); !ok {
+			continue
+		}
+		if msg.method.raw != nil || !msg.hasID() {
+			continue // request or notification of the stratum, e.g. mining.notify
+		}
+		submitTime, found := s.submits[key][string(msg.id.raw)]
+		if found {
+			delete(s.submits[key], string(msg.id.raw))
+		} else if submitTime, found = s.submitsSeq[key][ack]; found {
+			delete(s.submitsSeq[key], ack)
+		}
+		if !found {
+			continue
+		}
+		s.addProcessing(eventTime, key, eventTime.Sub(submitTime))
+		if result, ok := classifyShare(&msg); ok {
+			s.addShare(eventTime, key, result)
+		}
+	}
+}
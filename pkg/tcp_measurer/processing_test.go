@@ -0,0 +1,64 @@
+package tcpmeasurer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_SubmitProcessing(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+	submit := func(seq uint32, payload string) {
+		capture.send(captureStart, request(testMiner, seq, 1, payload))
+	}
+	respond := func(ack uint32, after time.Duration, payload string) {
+		capture.send(captureStart.Add(after), reply(testMiner, 1, ack, payload))
+	}
+
+	// when
+	submit(100, `{"id":1,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n")
+	respond(163, time.Millisecond, `{"id":1,"result":true,"error":null}`+"\n")
+	submit(200, `{"method":"mining.submit","params":["wg1.rig","BSV-1","00","01","02"],"id":"s2"}`+"\n"+`{"params":["wg1.rig","BSV-1","03","04","05"],"id":3,"method":"mining.submit"}`+"\n")
+	respond(1, 2*time.Millisecond, `{"id":null,"method":"mining.notify","params":["BSV-2"]}`+"\n"+`{"id":3,"result":true,"error":null}`+"\n"+`{"error":null,"result":true,"id":"s2"}`+"\n")
+	truncated := `{"params": ["wg1.rig", "BSV-1", "00000000` // cut by snap length before id
+	submit(300, truncated)
+	respond(300+uint32(len(truncated)), 3*time.Millisecond, `{"id":4,"result":false,"error":[23,"Low difficulty share",null]}`+"\n")
+	respond(1, 4*time.Millisecond, `{"id":5,"result":true,"error":null}`+"\n") // submit is not captured
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	result := resultOf(t, sink, "wg1.rig")
+	require.Equal(t, uint64(3), result.ProcessingCount, "authorize response is not a submit")
+	require.InDelta(t, 2, result.ProcessingMedian, 2*0.01)
+	require.Equal(t, float64(3), result.ProcessingMax)
+	require.Contains(t, metricsText(t, srv), "tcpmeasurer_processing_samples_total 3\n")
+}
+
+func TestService_SubmitProcessing_Fixture(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithLatencyUnit(time.Microsecond))
+	require.NoError(t, srv.ReadFilePureGO("samples/fixture-sll.pcap"))
+
+	// when
+	srv.Stop()
+
+	// then
+	expected := map[string]uint64{
+		"lp-wg3-s19jpro.cos-pb11-r4a2-96":  7,
+		"lp-wg5-s19jpro.cos-pb13-r1f6-100": 8,
+		"sfm-wg3-m30s++.CA040A00098F":      9,
+	}
+	results := sink.written()
+	require.Len(t, results, len(expected))
+	for _, r := range results {
+		require.Equal(t, expected[r.WorkerGroup], r.ProcessingCount, r.WorkerGroup)
+		require.True(t, r.ProcessingMedian <= r.ProcessingP95 && r.ProcessingP95 <= r.ProcessingP99 && r.ProcessingP99 <= r.ProcessingMax, "%+v", r)
+		require.InDelta(t, 100, r.ProcessingMean, 30, "stratum responds in ~0.1ms, network latency is 30..70ms")
+	}
+}
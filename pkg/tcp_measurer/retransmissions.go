@@ -0,0 +1,142 @@
+package tcpmeasurer
+
+import (
+	"orchestrator/common/pkg/utils"
+	"time"
+)
+
+// loss on the miner connection is seen from the stratum side of the capture: stratum segment with data which starts
+// before the highest sequence already sent is retransmitted, pure ACK of the miner which repeats the previous one with
+// the same window while stratum data is outstanding is duplicate ACK, see RFC 5681. It is not known which send of the
+// retransmitted segment is acknowledged, so ACK which covers it gives no latency sample (Karn's rule).
+
+// tcpEvent is counted per miner connection in the window of the packet
+type tcpEvent uint8
+
+const (
+	tcpEventSegment    tcpEvent = iota // stratum segment with data, retransmitted ones are included
+	tcpEventRetransmit                 // stratum segment with data which is already sent
+	tcpEventACK                        // miner segment with ACK, duplicate ones are included
+	tcpEventDupACK                     // duplicate ACK of the miner
+	tcpEventReset                      // RST of any side, it is counted once per connection
+	tcpEventFIN                        // FIN of any side, retransmitted FIN is not counted
+	tcpEventOpen                       // connection opened by SYN of the miner, see connections.go
+	tcpEventClose                      // connection closed by RST, FIN of both sides or the new connection from the address
+	tcpEventReconnect                  // connection of the worker group opened after another one of its connections is closed or evicted
+	tcpEvents
+)
+
+// names are used as metric label
+var tcpEventNames = [tcpEvents]string{
+	tcpEventSegment:    "segment",
+	tcpEventRetransmit: "retransmit",
+	tcpEventACK:        "ack",
+	tcpEventDupACK:     "duplicate_ack",
+	tcpEventReset:      "reset",
+	tcpEventFIN:        "fin",
+	tcpEventOpen:       "open",
+	tcpEventClose:      "close",
+	tcpEventReconnect:  "reconnect",
+}
+
+func (e tcpEvent) String() string {
+	return tcpEventNames[e]
+}
+
+// tcpEventCounts counts tcp events of the miner by kind
+type tcpEventCounts [tcpEvents]uint64
+
+func (c *tcpEventCounts) merge(other *tcpEventCounts) {
+	for i := range c {
+		c[i] += other[i]
+	}
+}
+
+// rate returns part of events, e.g. retransmits of all segments, it is zero if there are no events
+func (c *tcpEventCounts) rate(part, total tcpEvent) float64 {
+	if c[total] == 0 {
+		return 0
+	}
+	return float64(c[part]) / float64(c[total])
+}
+
+// flowState is sequence state of the miner connection
+type flowState struct {
+	sndMax     uint32 // end sequence of the stratum data sent so far
+	lastACK    uint32 // highest acknowledgment of the miner
+	window     uint16 // window of the miner segment with lastACK
+	hasSeq     bool   // sndMax is known
+	hasACK     bool   // lastACK is known
+	reset      bool
+	finStratum bool
+	finMiner   bool
+}
+
+// processFlow counts tcp events of the packet, it returns true if stratum segment with data is retransmitted
+func (s *shard) processFlow(eventTime time.Time, key connKey, isIncoming bool, pkt *tcpPacket) (retransmitted bool) {
+	var counts tcpEventCounts
+	syn, fin := pkt.flags&tcpFlagSYN != 0, pkt.flags&tcpFlagFIN != 0
+
+	c := s.trackConnection(eventTime, key, isIncoming, pkt, &counts)
+	s.evictHosts()
+	f := &c.flow
+	if pkt.flags&tcpFlagRST != 0 && !f.reset {
+		f.reset = true
+		counts[tcpEventReset]++
+		if s.closeConnection(eventTime, c) {
+			counts[tcpEventClose]++
+		}
+	}
+	if fin && (isIncoming && !f.finMiner || !isIncoming && !f.finStratum) {
+		f.finMiner, f.finStratum = f.finMiner || isIncoming, f.finStratum || !isIncoming
+		counts[tcpEventFIN]++
+		if f.finMiner && f.finStratum && s.closeConnection(eventTime, c) {
+			counts[tcpEventClose]++
+		}
+	}
+	switch {
+	case !isIncoming && syn:
+		f.sndMax, f.hasSeq = pkt.seq+1, true
+	case !isIncoming && pkt.payloadLen > 0:
+		end := pkt.seq + uint32(pkt.payloadLen)
+		counts[tcpEventSegment]++
+		if f.hasSeq && !seqAfterOrEqual(pkt.seq, f.sndMax) {
+			counts[tcpEventRetransmit]++
+			retransmitted = true
+		}
+		if !f.hasSeq || seqAfterOrEqual(end, f.sndMax) {
+			f.sndMax, f.hasSeq = end, true
+		}
+	case isIncoming && pkt.flags&tcpFlagACK != 0:
+		counts[tcpEventACK]++
+		pure := pkt.payloadLen == 0 && pkt.flags&(tcpFlagSYN|tcpFlagFIN|tcpFlagRST) == 0
+		outstanding := f.hasSeq && !seqAfterOrEqual(pkt.ack, f.sndMax)
+		if pure && outstanding && f.hasACK && pkt.ack == f.lastACK && pkt.window == f.window {
+			counts[tcpEventDupACK]++
+		}
+		if !f.hasACK || seqAfterOrEqual(pkt.ack, f.lastACK) {
+			f.lastACK, f.window, f.hasACK = pkt.ack, pkt.window, true
+		}
+	}
+
+	if counts != (tcpEventCounts{}) {
+		s.addTCPEvents(eventTime, key, &counts)
+	}
+	return retransmitted
+}
+
+// addTCPEvents counts tcp events in the window of the packet, same as addShare.
+// Events of closed windows are dropped without lateSamples, they are not samples.
+func (s *shard) addTCPEvents(eventTime time.Time, targetHost connKey, counts *tcpEventCounts) {
+	window := utils.RoundToNearest5Minutes(eventTime)
+	if s.windowClosed(window, s.eventWatermark()) {
+		return
+	}
+	if _, ok := s.events[window]; !ok {
+		s.events[window] = make(map[connKey]*tcpEventCounts, 5000)
+	}
+	if _, ok := s.events[window][targetHost]; !ok {
+		s.events[window][targetHost] = &tcpEventCounts{}
+	}
+	s.events[window][targetHost].merge(counts)
+}
@@ -0,0 +1,86 @@
+package tcpmeasurer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_TCPEvents(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+	send := func(after time.Duration, seg testSegment) {
+		capture.send(captureStart.Add(after), seg)
+	}
+	confirmation := func(ack uint32, window uint16) testSegment {
+		return testSegment{src: testMiner, dst: testStratum, seq: 200, ack: ack, flags: tcpFlagACK, window: window}
+	}
+	length := uint32(len(testPayload))
+
+	// when
+	send(0, testSegment{src: testMiner, dst: testStratum, seq: 99, flags: tcpFlagSYN})
+	send(time.Millisecond, testSegment{src: testStratum, dst: testMiner, seq: 999, ack: 100, flags: tcpFlagSYN | tcpFlagACK})
+	authorize := request(testMiner, 100, 1000, `{"id":1,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n")
+	authorize.window = 500
+	send(41*time.Millisecond, authorize)
+	send(50*time.Millisecond, response(testMiner, 1000))
+	send(51*time.Millisecond, response(testMiner, 1000+length)) // lost
+	send(52*time.Millisecond, response(testMiner, 1000+2*length))
+	send(90*time.Millisecond, confirmation(1000+length, 500))
+	send(91*time.Millisecond, confirmation(1000+length, 500))
+	send(92*time.Millisecond, confirmation(1000+length, 500))
+	send(93*time.Millisecond, confirmation(1000+length, 500))
+	send(94*time.Millisecond, confirmation(1000+length, 600)) // window update
+	send(95*time.Millisecond, response(testMiner, 1000+length))
+	send(135*time.Millisecond, confirmation(1000+3*length, 600)) // covers retransmitted segment
+	send(140*time.Millisecond, testSegment{src: testStratum, dst: testMiner, seq: 1000 + 3*length, ack: 200, flags: tcpFlagFIN | tcpFlagACK})
+	send(141*time.Millisecond, testSegment{src: testStratum, dst: testMiner, seq: 1000 + 3*length, ack: 200, flags: tcpFlagFIN | tcpFlagACK})
+	send(180*time.Millisecond, testSegment{src: testMiner, dst: testStratum, seq: 200, ack: 1001 + 3*length, flags: tcpFlagFIN | tcpFlagACK})
+	send(181*time.Millisecond, testSegment{src: testMiner, dst: testStratum, seq: 201, flags: tcpFlagRST})
+	send(182*time.Millisecond, testSegment{src: testMiner, dst: testStratum, seq: 201, flags: tcpFlagRST})
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	require.Len(t, sink.written(), 1)
+	result := resultOf(t, sink, "wg1.rig")
+	require.Equal(t, uint64(1), result.Count, "ACK of retransmitted segment gives no sample")
+	require.Equal(t, float64(40), result.Max)
+	require.Equal(t, uint64(4), result.Segments)
+	require.Equal(t, uint64(1), result.Retransmits)
+	require.Equal(t, 0.25, result.RetransmitRate)
+	require.Equal(t, uint64(8), result.MinerACKs)
+	require.Equal(t, uint64(3), result.DupACKs, "window update is not duplicate ACK")
+	require.Equal(t, 3.0/8, result.DupACKRate)
+	require.Equal(t, uint64(1), result.Resets)
+	require.Equal(t, uint64(2), result.FINs, "retransmitted FIN is not counted")
+	metrics := metricsText(t, srv)
+	require.Contains(t, metrics, `tcpmeasurer_tcp_events_total{worker_group="wg1.rig",coin="unknown",event="retransmit"} 1`)
+	require.Contains(t, metrics, `tcpmeasurer_tcp_events_total{worker_group="wg1.rig",coin="unknown",event="duplicate_ack"} 3`)
+}
+
+func TestService_TCPEvents_NewConnection(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+
+	// when
+	capture.send(captureStart, request(testMiner, 100, 1000, `{"id":1,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n"))
+	capture.send(captureStart.Add(time.Millisecond), response(testMiner, 1000))
+	capture.send(captureStart.Add(time.Second), testSegment{src: testMiner, dst: testStratum, seq: 4999, flags: tcpFlagSYN})
+	capture.send(captureStart.Add(2*time.Second), request(testMiner, 5000, 1000, `{"id":1,"method":"mining.authorize","params":["wg2.rig","x"]}`+"\n"))
+	capture.send(captureStart.Add(3*time.Second), response(testMiner, 1000))
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	require.Len(t, srv.Connections(), 2, "previous connection of the address is retired")
+	previous, current := resultOf(t, sink, "wg1.rig"), resultOf(t, sink, "wg2.rig")
+	require.Equal(t, uint64(1), previous.Segments)
+	require.Equal(t, uint64(1), current.Segments)
+	require.Zero(t, current.Retransmits, "SYN of the miner starts a new connection on the same address")
+}
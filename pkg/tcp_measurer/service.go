@@ -2,7 +2,6 @@ package tcpmeasurer
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -10,38 +9,69 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
 	"github.com/google/uuid"
 )
 
+// MeasurerContainer is stratum segment waiting for ACK of the miner, it is kept by value, so tracking the segment
+// does not allocate
 type MeasurerContainer struct {
-	EventTime  time.Time
-	RemoteHost string
-	SenderHost string
+	EventTime time.Time
+	JobID     string // job of mining.notify in the stratum segment, set in notify propagation mode
+
+	Retransmitted bool // segment is sent again, ACK of it gives no latency sample (Karn's rule)
 }
 
+const (
+	// CaptureModeTCPDump runs tcpdump which rotates pcap files, files are parsed in background
+	CaptureModeTCPDump = "tcpdump"
+	// CaptureModeAFPacket reads packets directly from AF_PACKET socket without external tools
+	CaptureModeAFPacket = "afpacket"
+)
+
+// tcpdumpStopTimeout is how long tcpdump has to flush the capture file after stop before it is killed
+const tcpdumpStopTimeout = 10 * time.Second
+
 type Service struct {
 	l                  logger.AppLogger
 	ctx                context.Context
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup // background jobs and capture, Stop waits for them
+	stopOnce           sync.Once
 	observePort        uint64
 	observePortStr     string
 	observeInterface   string
 	appName            string
-	data               map[string]map[uint32]*MeasurerContainer // targetHost -> sequence -> time.Start and time.End
-	dataSeq            map[string]map[uint32]*MeasurerContainer // targetHost -> sequence -> time.Start and time.End
-	buffer             map[time.Time]map[string][]float64       // time5minAggregation -> targetHost -> latency
+	captureMode        string
+	snapLen            int
+	shards             []*shard // state of miner connections, see shard.go
+	shardCount         int
+	latencyUnit        time.Duration
+	allowedLateness    time.Duration
+	idleTimeout        time.Duration
+	maxHosts           int // see limits.go
+	maxHostEntries     int
+	maxIdleAge         time.Duration
+	watermark          atomic.Int64  // max event time in unix nanoseconds, closes windows
+	lateReported       atomic.Uint64 // late samples already reported by DumpIt
 	dumpBufferInterval time.Duration
 	cleanInterval      time.Duration
 	parseFilesInterval time.Duration
 	filesPath          string
 	skipCMD            bool
+	captureStopped     atomic.Bool // tcpdump exited after stop, so the newest capture file is complete
+	notifyPropagation  bool        // mining.notify delivery is measured, see WithNotifyPropagation
+	timestampRTT       bool        // RTT is estimated by TCP timestamps as well, see WithTimestampRTT
+	metricsAddr        string
+	sinks              []Sink
+	metrics            *metrics
+	restartDelay       time.Duration
 
-	mu                sync.RWMutex
-	dataMUSeq         sync.Mutex
-	matchedMiners     map[string]string
-	matchedMinersCoin map[string]string
+	coinRules   []CoinRule
+	defaultCoin string
 }
 
 type Opt func(*Service)
@@ -52,6 +82,19 @@ func WithCustomApp(appName string) Opt {
 	}
 }
 
+// WithCaptureMode selects how packets are captured, see CaptureModeTCPDump and CaptureModeAFPacket
+func WithCaptureMode(mode string) Opt {
+	return func(s *Service) {
+		s.captureMode = mode
+	}
+}
+
+func WithObserveInterface(iface string) Opt {
+	return func(s *Service) {
+		s.observeInterface = iface
+	}
+}
+
 func WithSkipCMD(flag string) Opt {
 	return func(s *Service) {
 		s.skipCMD = flag == "1"
@@ -59,30 +102,48 @@ func WithSkipCMD(flag string) Opt {
 }
 
 func NewService(ctx context.Context, l logger.AppLogger, observePort uint64, opts ...Opt) *Service {
+	ctx, cancel := context.WithCancel(ctx)
 	srv := &Service{
 		ctx:                ctx,
+		cancel:             cancel,
 		observePort:        observePort,
 		observePortStr:     fmt.Sprintf("%d", observePort),
 		observeInterface:   "any",
 		l:                  l.With(slog.String("service", "tcpmeasurer")),
 		appName:            "tcpdump",
-		data:               make(map[string]map[uint32]*MeasurerContainer),
-		dataSeq:            make(map[string]map[uint32]*MeasurerContainer),
-		buffer:             make(map[time.Time]map[string][]float64, 10),
-		dumpBufferInterval: 5 * time.Minute,
+		captureMode:        CaptureModeTCPDump,
+		snapLen:            145,
+		latencyUnit:        time.Millisecond,
+		allowedLateness:    time.Minute,
+		idleTimeout:        defaultConnectionIdleTimeout,
+		maxHosts:           defaultMaxHosts,
+		maxHostEntries:     defaultMaxHostEntries,
+		maxIdleAge:         defaultMaxIdleAge,
+		dumpBufferInterval: 30 * time.Second,
 		cleanInterval:      5 * time.Minute,
 		parseFilesInterval: 2 * time.Second,
 		filesPath:          "/tmp/",
-		matchedMiners:      make(map[string]string),
-		matchedMinersCoin:  make(map[string]string),
+		metrics:            newMetrics(),
+		restartDelay:       5 * time.Second,
+		coinRules:          defaultCoinRules,
+		defaultCoin:        unknownCoin,
 	}
+	srv.sinks = []Sink{NewLogSink(srv.l)}
 	for _, opt := range opts {
 		opt(srv)
 	}
+	srv.initShards()
 	return srv
 }
 
 func (s *Service) Init() error {
+	switch s.captureMode {
+	case CaptureModeTCPDump:
+	case CaptureModeAFPacket:
+		return nil // capturer does not depend on external tools
+	default:
+		return fmt.Errorf("unknown capture mode: %s", s.captureMode)
+	}
 	_, err := exec.LookPath(s.appName)
 	if err != nil {
 		return fmt.Errorf("app %s is not installed: %w", s.appName, err)
@@ -90,31 +151,73 @@ func (s *Service) Init() error {
 	return nil
 }
 
+// Stop stops capture and background jobs, parses capture files which are left and flushes all windows.
+// Flushed windows are marked as partial, packets of them which are not captured yet are lost.
 func (s *Service) Stop() {
-	return
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	for key := range s.buffer {
-		s.processData(key, s.buffer[key])
-	}
+	s.stopOnce.Do(func() {
+		s.l.Info("stopping service")
+		s.cancel()
+		s.wg.Wait()
+		if s.captureMode == CaptureModeTCPDump {
+			s.drainFiles()
+		}
+		s.flushAll()
+		s.l.Info("service stopped")
+	})
 }
 
 func (s *Service) Start() error {
-	go s.parsePCAPFiles()
-	go s.DumpData()
-	go s.CleanOld()
+	s.goBackground(s.DumpData)
+	s.goBackground(s.CleanOld)
+	if s.metricsAddr != "" {
+		s.goBackground(s.serveMetrics)
+	}
+	s.wg.Add(1)
+	defer s.wg.Done()
+	if s.captureMode == CaptureModeAFPacket {
+		s.l.Info("starting capturer", slog.String("interface", s.observeInterface))
+		return s.RunCapturer()
+	}
+	s.goBackground(s.parsePCAPFiles)
 	if s.skipCMD {
 		s.l.Info("skipping CMD")
 		return nil
 	}
 	s.l.Info("starting CMD")
-	return s.RunCMD()
+	return s.runWithRestarts(s.RunCMD)
+}
+
+func (s *Service) goBackground(job func()) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		job()
+	}()
+}
+
+// runWithRestarts restarts capture process until service context is done
+func (s *Service) runWithRestarts(run func() error) error {
+	for {
+		err := run()
+		if s.ctx.Err() != nil {
+			return err
+		}
+		s.metrics.captureRestarts.Add(1)
+		s.l.Error("capture process exited, restarting", err, slog.Duration("delay", s.restartDelay))
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(s.restartDelay):
+		}
+	}
 }
 func (s *Service) RunCMD() error {
+	// libpcap supports tcp[] offsets only for IPv4, so IPv6 segments pass the flags check as is
 	executor := fmt.Sprintf(
-		"sudo %s -i %s -ttttt -X -s 145 -e -w %s/caapture-%s-%s.pcap -G %d 'tcp port %d and (tcp[tcpflags] & (tcp-syn|tcp-ack) != 0)'",
+		"trap : TERM; sudo %s -i %s -ttttt --time-stamp-precision=nano -X -s %d -e -w %s/caapture-%s-%s.pcap -G %d 'tcp port %d and (ip6 or tcp[tcpflags] & (tcp-syn|tcp-ack|tcp-rst) != 0)'",
 		s.appName,
 		s.observeInterface,
+		s.snapLen,
 		strings.TrimSuffix(s.filesPath, "/"),
 		`%Y_%m_%d_%H_%M_%S`, // file format, we will sort it
 		uuid.NewString()[:5],
@@ -122,7 +225,9 @@ func (s *Service) RunCMD() error {
 		s.observePort,
 	)
 	s.l.Info("executor", slog.String("executor", executor))
+	// trap keeps the shell waiting for tcpdump on SIGTERM, so the command exits once the capture file is flushed
 	cmd := exec.CommandContext(s.ctx, "/bin/sh", "-c", executor)
+	setProcessGroup(cmd)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to get stdout pipe: %w", err)
@@ -138,7 +243,20 @@ func (s *Service) RunCMD() error {
 
 	go s.copyOutput(stdout)
 	go s.copyOutput(stderr)
-	return cmd.Wait()
+	err = cmd.Wait()
+	// process which is killed after tcpdumpStopTimeout may leave tcpdump running
+	s.captureStopped.Store(s.ctx.Err() != nil && cmd.ProcessState != nil && cmd.ProcessState.Exited())
+	return err
+}
+
+// RunCapturer reads packets from AF_PACKET socket and feeds them into the same state machine as pcap files
+func (s *Service) RunCapturer() error {
+	src, err := NewLiveSource(s.ctx, s.observeInterface, s.observePort, s.snapLen)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return s.ReadSource(src)
 }
 
 func (s *Service) copyOutput(r io.Reader) {
@@ -147,36 +265,3 @@ func (s *Service) copyOutput(r io.Reader) {
 		s.l.Info(scanner.Text())
 	}
 }
-
-var (
-	prefix    = []byte(`{"params":`)
-	separator = []byte(`",`)
-	bsv       = []byte(`"BSV-`)
-	bch       = []byte(`"BCH-`)
-)
-
-func ExtractWorkerGroup(payload []byte) (workerGroup, coin string) {
-	if !bytes.HasPrefix(payload, prefix) {
-		return "", ""
-	}
-	position := 0
-	for i := range payload {
-		if i+1 >= len(payload) {
-			break
-		}
-		if separator[0] == payload[i] && separator[1] == payload[i+1] {
-			position = i
-			break
-		}
-	}
-	if position == 0 {
-		return "", ""
-	}
-
-	if bytes.Contains(payload[position:], bsv) {
-		coin = "BSV"
-	} else if bytes.Contains(payload[position:], bch) {
-		coin = "BCH"
-	}
-	return string(payload[len(prefix)+3 : position]), coin
-}
@@ -49,6 +49,21 @@ func TestExtractWorkerGroup(t *testing.T) {
 			"sfm-wg2-m30s++.CA051700EC1B",
 			"BSV",
 		},
+		{
+			`{"id":171118,"method":"mining.submit","params":["sfm-wg2-m30s++.CA051700EC1B","BCH-846861-89d48","00000000"]}`,
+			"sfm-wg2-m30s++.CA051700EC1B",
+			"BCH",
+		},
+		{
+			`{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}` + "\n" + `{"id":3,"method":"mining.authorize","params":["lp-wg4-s19jpro.cos-pb12-r7b1-96","x"]}` + "\n",
+			"lp-wg4-s19jpro.cos-pb12-r7b1-96",
+			"",
+		},
+		{
+			`{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}`,
+			"",
+			"",
+		},
 	}
 	for _, tc := range table {
 		res, coin := tcpmeasurer.ExtractWorkerGroup([]byte(tc.input))
@@ -57,6 +72,46 @@ func TestExtractWorkerGroup(t *testing.T) {
 	}
 }
 
+func TestService_ExtractWorkerGroup(t *testing.T) {
+	srv := tcpmeasurer.NewService(context.Background(), getLogger(t), 3333,
+		tcpmeasurer.WithCoinRules(tcpmeasurer.CoinRule{Coin: "BTC", Worker: "lp-*"}),
+		tcpmeasurer.WithDefaultCoin("BSV"),
+	)
+	table := map[string]struct {
+		input         string
+		expectedGroup string
+		expectedCoin  string
+	}{
+		"configured rule": {
+			`{"id":3,"method":"mining.authorize","params":["lp-wg4-s19jpro.cos-pb12-r7b1-96","x"]}`,
+			"lp-wg4-s19jpro.cos-pb12-r7b1-96",
+			"BTC",
+		},
+		"built-in prefix": {
+			`{"id":171118,"method":"mining.submit","params":["sfm-wg2-m30s++.CA051700EC1B","BCH-846861-89d48","00000000"]}`,
+			"sfm-wg2-m30s++.CA051700EC1B",
+			"BCH",
+		},
+		"default coin": {
+			`{"id":3,"method":"mining.authorize","params":["sfm-wg2-m30s++.CA051700EC1B","x"]}`,
+			"sfm-wg2-m30s++.CA051700EC1B",
+			"BSV",
+		},
+		"no worker": {
+			`{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}`,
+			"",
+			"",
+		},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			group, coin := srv.ExtractWorkerGroup([]byte(tc.input))
+			require.Equal(t, tc.expectedGroup, group)
+			require.Equal(t, tc.expectedCoin, coin)
+		})
+	}
+}
+
 func getLogger(t *testing.T) logger.AppLogger {
 	appLogger, err := logger.NewAppSLogger(
 		&logger.Config{
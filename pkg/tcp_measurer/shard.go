@@ -0,0 +1,215 @@
+package tcpmeasurer
+
+import (
+	"container/list"
+	"orchestrator/common/pkg/sketch"
+	"orchestrator/common/pkg/utils"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// state of miner connections is partitioned by the connection 4-tuple into shards, both directions of the connection
+// go to the same shard. Dispatcher decodes frames and passes packets to the worker goroutine of the shard, so packets of
+// the connection keep capture order and shards are processed on multiple cores. Shard mutex is held by the worker per
+// packet, it is contended only by DumpIt, CleanIt, metrics and the connection table.
+// Watermark is moved by the dispatcher, before it passes close time of the window workers process queued packets,
+// so window is closed only after all packets captured before the close are in it.
+
+// shardQueueLen is how many packets may wait for the worker of the shard
+const shardQueueLen = 1024
+
+// WithShards sets number of shards, every shard has its own worker goroutine, default is GOMAXPROCS
+func WithShards(shards int) Opt {
+	return func(s *Service) {
+		if shards > 0 {
+			s.shardCount = shards
+		}
+	}
+}
+
+type shard struct {
+	*Service // configuration, watermark and metrics are shared by shards
+
+	mu                sync.Mutex
+	dataSeq           map[connKey]map[uint32]MeasurerContainer   // targetHost -> end sequence of the stratum segment -> time.Start
+	buffer            map[time.Time]map[connKey]*sketch.DDSketch // time5minAggregation -> targetHost -> latency in nanoseconds
+	processing        map[time.Time]map[connKey]*sketch.DDSketch // time5minAggregation -> targetHost -> submit processing in nanoseconds
+	handshakeRTT      map[time.Time]map[connKey]*sketch.DDSketch // time5minAggregation -> targetHost -> handshake RTT in nanoseconds
+	tsRTT             map[time.Time]map[connKey]*sketch.DDSketch // time5minAggregation -> targetHost -> RTT by TCP timestamps in nanoseconds
+	shares            map[time.Time]map[connKey]*shareCounts     // time5minAggregation -> targetHost -> submits by result
+	events            map[time.Time]map[connKey]*tcpEventCounts  // time5minAggregation -> targetHost -> retransmits, duplicate ACKs, RST and FIN
+	tsSent            map[connKey]map[uint32]time.Time           // targetHost -> TSval of the stratum -> first segment with it
+	handshakes        map[connKey]*handshake                     // targetHost -> handshake which is not completed yet
+	connections       map[connKey]*connection                    // targetHost -> connection table, see connections.go
+	hostsLRU          *list.List                                 // keys of connections, the most recently seen first
+	hostsLimit        int                                        // share of maxHosts
+	workers           map[string]*workerConnections              // worker group -> its connections in the table, for reconnects
+	notifyJobs        map[string]*notifyJob                      // job id -> mining.notify deliveries of the shard, jobs of shards are merged by DumpIt
+	submits           map[connKey]map[string]time.Time           // targetHost -> JSON-RPC id -> submit time
+	submitsSeq        map[connKey]map[uint32]time.Time           // targetHost -> sequence after the submit -> submit time, for submits truncated before id
+	matchedMiners     map[connKey]string
+	matchedMinersCoin map[connKey]string // empty if no coin rule matched
+}
+
+func newShard(s *Service, hostsLimit int) *shard {
+	return &shard{
+		Service:           s,
+		dataSeq:           make(map[connKey]map[uint32]MeasurerContainer),
+		buffer:            make(map[time.Time]map[connKey]*sketch.DDSketch, 10),
+		processing:        make(map[time.Time]map[connKey]*sketch.DDSketch, 10),
+		handshakeRTT:      make(map[time.Time]map[connKey]*sketch.DDSketch, 10),
+		tsRTT:             make(map[time.Time]map[connKey]*sketch.DDSketch, 10),
+		shares:            make(map[time.Time]map[connKey]*shareCounts, 10),
+		events:            make(map[time.Time]map[connKey]*tcpEventCounts, 10),
+		tsSent:            make(map[connKey]map[uint32]time.Time),
+		handshakes:        make(map[connKey]*handshake),
+		connections:       make(map[connKey]*connection),
+		hostsLRU:          list.New(),
+		hostsLimit:        hostsLimit,
+		workers:           make(map[string]*workerConnections),
+		notifyJobs:        make(map[string]*notifyJob),
+		submits:           make(map[connKey]map[string]time.Time),
+		submitsSeq:        make(map[connKey]map[uint32]time.Time),
+		matchedMiners:     make(map[connKey]string),
+		matchedMinersCoin: make(map[connKey]string),
+	}
+}
+
+// initShards splits state into shards once options are applied
+func (s *Service) initShards() {
+	if s.shardCount <= 0 {
+		s.shardCount = runtime.GOMAXPROCS(0)
+	}
+	hostsLimit := (s.maxHosts + s.shardCount - 1) / s.shardCount
+	s.shards = make([]*shard, s.shardCount)
+	for i := range s.shards {
+		s.shards[i] = newShard(s, hostsLimit)
+	}
+}
+
+// shardOf returns shard of the packet connection
+func (s *Service) shardOf(pkt *tcpPacket) *shard {
+	return s.shards[s.shardIndex(pkt)]
+}
+
+func (s *Service) shardIndex(pkt *tcpPacket) int {
+	return int(pkt.flowHash() % uint32(len(s.shards)))
+}
+
+// flowHash is FNV-1a of the connection 4-tuple, it is the same for both directions
+func (p *tcpPacket) flowHash() uint32 {
+	return endpointHash(p.srcIP, p.srcPort) ^ endpointHash(p.dstIP, p.dstPort)
+}
+
+func endpointHash(ip []byte, port uint16) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for _, b := range ip {
+		h = (h ^ uint32(b)) * prime32
+	}
+	h = (h ^ uint32(port>>8)) * prime32
+	return (h ^ uint32(port&0xff)) * prime32
+}
+
+// lockShards locks every shard in order, so DumpIt sees consistent state of all connections
+func (s *Service) lockShards() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (s *Service) unlockShards() {
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+// closesWindow reports if the event time moves the watermark past close time of the window
+func (s *Service) closesWindow(eventTime time.Time) bool {
+	watermark := s.eventWatermark()
+	if watermark.IsZero() || !eventTime.After(watermark) {
+		return false
+	}
+	// windows which end before the watermark minus allowed lateness are closed
+	return !utils.RoundToNearest5Minutes(eventTime.Add(-s.allowedLateness)).Equal(utils.RoundToNearest5Minutes(watermark.Add(-s.allowedLateness)))
+}
+
+// packetPool keeps copies of packets queued for workers, packet memory of the source is reused after the handler returns
+var packetPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+type shardJob struct {
+	eventTime time.Time
+	pkt       tcpPacket       // points into buf
+	buf       *[]byte         // returned to packetPool once the packet is processed
+	barrier   *sync.WaitGroup // set by drain, job has no packet then
+}
+
+// dispatcher passes packets of one PacketSource to the shard workers
+type dispatcher struct {
+	s      *Service
+	queues []chan shardJob
+	wg     sync.WaitGroup
+}
+
+// newDispatcher starts worker of every shard, close stops them
+func (s *Service) newDispatcher() *dispatcher {
+	d := &dispatcher{s: s, queues: make([]chan shardJob, len(s.shards))}
+	for i, sh := range s.shards {
+		d.queues[i] = make(chan shardJob, shardQueueLen)
+		d.wg.Add(1)
+		go d.work(sh, d.queues[i])
+	}
+	return d
+}
+
+func (d *dispatcher) work(sh *shard, queue <-chan shardJob) {
+	defer d.wg.Done()
+	for job := range queue {
+		if job.barrier != nil {
+			job.barrier.Done()
+			continue
+		}
+		sh.mu.Lock()
+		sh.processTCPPacket(job.eventTime, &job.pkt)
+		sh.mu.Unlock()
+		packetPool.Put(job.buf)
+	}
+}
+
+// processPacket copies the packet and queues it to the worker of its shard, packet memory may be reused after the call
+func (d *dispatcher) processPacket(eventTime time.Time, pkt *tcpPacket) {
+	if d.s.closesWindow(eventTime) {
+		d.drain()
+	}
+	d.s.observeEventTime(eventTime)
+	job := shardJob{eventTime: eventTime, buf: packetPool.Get().(*[]byte)}
+	job.pkt, *job.buf = pkt.clone(*job.buf)
+	d.queues[d.s.shardIndex(&job.pkt)] <- job
+}
+
+// drain waits until workers process queued packets
+func (d *dispatcher) drain() {
+	var barrier sync.WaitGroup
+	barrier.Add(len(d.queues))
+	for _, queue := range d.queues {
+		queue <- shardJob{barrier: &barrier}
+	}
+	barrier.Wait()
+}
+
+// close waits until queued packets are processed and stops workers
+func (d *dispatcher) close() {
+	for _, queue := range d.queues {
+		close(queue)
+	}
+	d.wg.Wait()
+}
@@ -0,0 +1,98 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var shardTestFiles = []string{
+	"samples/caapture-20240531134340.pcap",
+	"samples/caapture-20240531134355.pcap",
+	"samples/caapture-20240531134410.pcap",
+	"samples/caapture-20240531134440.pcap",
+}
+
+func TestTCPPacket_FlowHash(t *testing.T) {
+	response := testResponse(testStratum, testMiner)
+	var outgoing, incoming tcpPacket
+	require.NoError(t, decodePacket(linkTypeLinuxSLL, buildSLL(response.ip()), &outgoing))
+	ack := testSegment{src: testMiner, dst: testStratum, seq: response.ack, ack: response.seq + uint32(len(testPayload)), flags: tcpFlagACK, window: 502}
+	require.NoError(t, decodePacket(linkTypeLinuxSLL, buildSLL(ack.ip()), &incoming))
+	require.Equal(t, outgoing.flowHash(), incoming.flowHash(), "both directions of the connection go to the same shard")
+
+	other := netip.AddrPortFrom(testMiner.Addr(), testMiner.Port()+1)
+	var reused tcpPacket
+	require.NoError(t, decodePacket(linkTypeLinuxSLL, buildSLL(testResponse(testStratum, other).ip()), &reused))
+	require.NotEqual(t, outgoing.flowHash(), reused.flowHash())
+}
+
+func TestService_Shards_SameResults(t *testing.T) {
+	// given
+	read := func(shards int) [][]WindowResult {
+		sink := &recordingSink{}
+		srv := newTestService(t, WithSinks(sink), WithShards(shards))
+		for _, file := range shardTestFiles {
+			require.NoError(t, srv.ReadFilePureGO(file))
+		}
+		srv.flushAll()
+		return sink.results
+	}
+
+	// when
+	expected := read(1)
+	sharded := read(8)
+
+	// then
+	require.NotEmpty(t, expected)
+	require.Equal(t, expected, sharded)
+}
+
+func TestService_Shards_Race(t *testing.T) {
+	// given
+	srv := newTestService(t, WithSinks(&recordingSink{}), WithShards(4))
+	done := make(chan struct{})
+	var readers, housekeeping sync.WaitGroup
+	errs := make([]error, len(shardTestFiles)) // require may be called only by the test goroutine
+
+	// when
+	for i, file := range shardTestFiles {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			errs[i] = srv.ReadFilePureGO(file)
+		}()
+	}
+	housekeeping.Add(1)
+	go func() {
+		defer housekeeping.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			srv.DumpIt()
+			srv.CleanIt()
+			srv.Connections()
+			srv.writeMetrics(bufio.NewWriter(io.Discard))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	readers.Wait()
+	close(done)
+	housekeeping.Wait()
+	srv.flushAll()
+
+	// then
+	for i, err := range errs {
+		require.NoError(t, err, shardTestFiles[i])
+	}
+	require.NotEmpty(t, srv.Connections())
+	require.NotZero(t, srv.metrics.latencySamples.Load())
+}
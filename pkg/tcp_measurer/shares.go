@@ -0,0 +1,188 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"orchestrator/common/pkg/utils"
+	"time"
+)
+
+// shareResult is outcome of mining.submit by the stratum response
+type shareResult uint8
+
+const (
+	shareAccepted shareResult = iota
+	shareStale
+	shareDuplicate
+	shareLowDifficulty
+	shareUnauthorized
+	shareNotSubscribed
+	shareRejected // reason is not known
+	shareResults
+)
+
+// names are used as reject reasons of the window result and as metric label
+var shareResultNames = [shareResults]string{
+	shareAccepted:      "accepted",
+	shareStale:         "stale",
+	shareDuplicate:     "duplicate",
+	shareLowDifficulty: "low_difficulty",
+	shareUnauthorized:  "unauthorized",
+	shareNotSubscribed: "not_subscribed",
+	shareRejected:      "rejected",
+}
+
+func (r shareResult) String() string {
+	return shareResultNames[r]
+}
+
+// shareCounts counts submits of the miner by result
+type shareCounts [shareResults]uint64
+
+func (c *shareCounts) merge(other *shareCounts) {
+	for i := range c {
+		c[i] += other[i]
+	}
+}
+
+// rejected returns count of rejected shares, stale ones are not included
+func (c *shareCounts) rejected() (total uint64, reasons map[string]uint64) {
+	for r := shareStale + 1; r < shareResults; r++ {
+		if c[r] == 0 {
+			continue
+		}
+		if reasons == nil {
+			reasons = make(map[string]uint64, 1)
+		}
+		reasons[r.String()] = c[r]
+		total += c[r]
+	}
+	return total, reasons
+}
+
+// error codes of stratum v1, 20 is "Other/Unknown", then reason is taken from the message
+var shareErrorCodes = map[string]shareResult{
+	"21": shareStale, // Job not found
+	"22": shareDuplicate,
+	"23": shareLowDifficulty,
+	"24": shareUnauthorized,
+	"25": shareNotSubscribed,
+}
+
+// message fragments are checked in order, they are lower case
+var shareErrorMessages = []struct {
+	fragment []byte
+	result   shareResult
+}{
+	{fragment: []byte("stale"), result: shareStale},
+	{fragment: []byte("job not found"), result: shareStale},
+	{fragment: []byte("duplicate"), result: shareDuplicate},
+	{fragment: []byte("low difficulty"), result: shareLowDifficulty},
+	{fragment: []byte("above target"), result: shareLowDifficulty},
+	{fragment: []byte("unauthorized"), result: shareUnauthorized},
+	{fragment: []byte("not subscribed"), result: shareNotSubscribed},
+}
+
+// classifyShare returns result of the submit by the stratum response, ok is false if response is cut before the result.
+// Error is either [code, "message", traceback], {"code": code, "message": "message"} or just a string.
+func classifyShare(msg *stratumMessage) (result shareResult, ok bool) {
+	if msg.err.truncated {
+		return 0, false // stale share can't be told from rejected one
+	}
+	if msg.err.raw != nil && !isJSONNull(msg.err) {
+		code, message := parseStratumError(msg.err)
+		if result, ok = shareErrorCodes[string(code)]; ok {
+			return result, true
+		}
+		return classifyShareMessage(message), true
+	}
+	if msg.result.raw == nil || msg.result.truncated {
+		return 0, false
+	}
+	if !msg.result.str && string(msg.result.raw) == "true" {
+		return shareAccepted, true
+	}
+	if msg.reason.isString() {
+		return classifyShareMessage(msg.reason.raw), true
+	}
+	return shareRejected, true
+}
+
+func classifyShareMessage(message []byte) shareResult {
+	if len(message) == 0 {
+		return shareRejected
+	}
+	message = bytes.ToLower(message)
+	for _, m := range shareErrorMessages {
+		if bytes.Contains(message, m.fragment) {
+			return m.result
+		}
+	}
+	return shareRejected
+}
+
+func isJSONNull(v stratumValue) bool {
+	return !v.str && string(v.raw) == "null"
+}
+
+func parseStratumError(v stratumValue) (code, message []byte) {
+	if v.str {
+		return nil, v.raw
+	}
+	sc := stratumScanner{data: v.raw}
+	switch {
+	case sc.consume('['):
+		sc.skipSpace()
+		c, err := sc.value()
+		if err != nil {
+			return nil, nil
+		}
+		sc.skipSpace()
+		if !sc.consume(',') {
+			return c.raw, nil
+		}
+		sc.skipSpace()
+		m, _ := sc.value()
+		return c.raw, m.raw
+	case sc.consume('{'):
+		for first := true; ; first = false {
+			sc.skipSpace()
+			if sc.consume('}') || !first && !sc.consume(',') {
+				return code, message
+			}
+			sc.skipSpace()
+			key, err := sc.value()
+			sc.skipSpace()
+			if err != nil || !sc.consume(':') {
+				return code, message
+			}
+			sc.skipSpace()
+			value, err := sc.value()
+			if err != nil {
+				return code, message
+			}
+			switch string(key.raw) {
+			case "code":
+				code = value.raw
+			case "message":
+				message = value.raw
+			}
+		}
+	}
+	return nil, nil
+}
+
+// addShare counts the submit result in the window of the response, same as addLatency
+func (s *shard) addShare(eventTime time.Time, targetHost connKey, result shareResult) {
+	window := utils.RoundToNearest5Minutes(eventTime)
+	if s.windowClosed(window, s.eventWatermark()) {
+		s.metrics.lateSamples.Add(1)
+		return
+	}
+	if _, ok := s.shares[window]; !ok {
+		s.shares[window] = make(map[connKey]*shareCounts, 5000)
+	}
+	if _, ok := s.shares[window][targetHost]; !ok {
+		s.shares[window][targetHost] = &shareCounts{}
+	}
+	s.shares[window][targetHost][result]++
+}
@@ -0,0 +1,106 @@
+package tcpmeasurer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sendShares authorizes wg1.rig, submits shares with ids from 2 and sends responses of the stratum
+func sendShares(capture *capture, submits int, responses ...string) {
+	capture.send(captureStart, request(testMiner, 100, 1, `{"id":1,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n"))
+	capture.send(captureStart.Add(time.Millisecond), reply(testMiner, 1, 1, `{"id":1,"result":true,"error":null}`+"\n"))
+	for id := range submits {
+		payload := `{"id":` + string(rune('2'+id)) + `,"method":"mining.submit","params":["wg1.rig","BSV-1","00","01","02"]}` + "\n"
+		capture.send(captureStart, request(testMiner, 200+uint32(id)*100, 1, payload))
+	}
+	for _, payload := range responses {
+		capture.send(captureStart.Add(time.Millisecond), reply(testMiner, 1, 1, payload))
+	}
+}
+
+func TestService_Shares_Classify(t *testing.T) {
+	table := map[string]struct {
+		payload  string
+		accepted uint64
+		stale    uint64
+		rejected map[string]uint64
+	}{
+		"accepted":                  {payload: `{"id":2,"result":true,"error":null}`, accepted: 1},
+		"error first":               {payload: `{"error":null,"id":2,"result":true}`, accepted: 1},
+		"stale by code":             {payload: `{"id":2,"result":null,"error":[21,"Job not found",null]}`, stale: 1},
+		"duplicate by code":         {payload: `{"id":2,"result":false,"error":[22,"Duplicate share",null]}`, rejected: map[string]uint64{"duplicate": 1}},
+		"low difficulty by message": {payload: `{"id":2,"result":false,"error":[20,"Low difficulty share",null]}`, rejected: map[string]uint64{"low_difficulty": 1}},
+		"object error":              {payload: `{"id":2,"result":false,"error":{"code":-32000,"message":"Stale share"}}`, stale: 1},
+		"object error code":         {payload: `{"id":2,"error":{"message":"oops","code":24}}`, rejected: map[string]uint64{"unauthorized": 1}},
+		"string error":              {payload: `{"id":2,"result":false,"error":"not subscribed"}`, rejected: map[string]uint64{"not_subscribed": 1}},
+		"unknown error":             {payload: `{"id":2,"result":false,"error":[20,"Other",null]}`, rejected: map[string]uint64{"rejected": 1}},
+		"reject reason":             {payload: `{"id":2,"result":false,"error":null,"reject-reason":"Above target"}`, rejected: map[string]uint64{"low_difficulty": 1}},
+		"rejected without reason":   {payload: `{"id":2,"result":false,"error":null}`, rejected: map[string]uint64{"rejected": 1}},
+		"truncated result":          {payload: `{"id":2,"res`},
+		"truncated error":           {payload: `{"id":2,"result":false,"error":[23,"Low diff`},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			sink := &recordingSink{}
+			srv := newTestService(t, WithSinks(sink))
+			capture := newCapture(t)
+			sendShares(capture, 1, tc.payload)
+			capture.replay(srv)
+
+			srv.Stop()
+
+			result := resultOf(t, sink, "wg1.rig")
+			require.Equal(t, tc.accepted, result.SharesAccepted)
+			require.Equal(t, tc.stale, result.SharesStale)
+			var rejected uint64
+			for _, count := range tc.rejected {
+				rejected += count
+			}
+			require.Equal(t, rejected, result.SharesRejected)
+			require.Equal(t, tc.rejected, result.RejectReasons)
+		})
+	}
+}
+
+func TestService_Shares(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	capture := newCapture(t)
+
+	// when
+	sendShares(capture, 5,
+		`{"id":2,"result":true,"error":null}`+"\n"+`{"id":3,"result":true,"error":null}`+"\n",
+		`{"id":4,"result":null,"error":[21,"Job not found",null]}`+"\n",
+		`{"id":5,"result":false,"error":[23,"Low difficulty share",null]}`+"\n"+`{"id":6,"result":false,"error":[22,"Duplicate share",null]}`+"\n",
+	)
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	results := sink.written()
+	require.Len(t, results, 1)
+	r := results[0]
+	require.Equal(t, uint64(2), r.SharesAccepted, "authorize response is not a share")
+	require.Equal(t, uint64(1), r.SharesStale)
+	require.Equal(t, uint64(2), r.SharesRejected)
+	require.Equal(t, map[string]uint64{"low_difficulty": 1, "duplicate": 1}, r.RejectReasons)
+	require.Contains(t, metricsText(t, srv), `tcpmeasurer_shares_total{worker_group="wg1.rig",coin="BSV",result="accepted"} 2`)
+}
+
+func TestService_Shares_Fixture(t *testing.T) {
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink))
+	require.NoError(t, srv.ReadFilePureGO("samples/fixture-sll.pcap"))
+
+	srv.Stop()
+
+	results := sink.written()
+	require.NotEmpty(t, results)
+	for _, r := range results {
+		require.Equal(t, r.ProcessingCount, r.SharesAccepted, r.WorkerGroup)
+		require.Zero(t, r.SharesStale+r.SharesRejected, r.WorkerGroup)
+	}
+}
@@ -0,0 +1,228 @@
+package tcpmeasurer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"bitbucket.org/Taal_Orchestrator/orca-std-go/entities"
+	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
+)
+
+// WindowResult is latency of the worker group aggregated over one observe interval.
+// Latency fields are in Unit, json names are the same as fields of the "miner latency" log. Worker group without
+// latency samples in the window has zero Count, its latency fields are omitted.
+type WindowResult struct {
+	WorkerGroup string    `json:"worker_group"`
+	Coin        string    `json:"mining_coin"`
+	Interval    time.Time `json:"observe_interval"` // start of the 5 minutes window
+	Partial     bool      `json:"partial"`          // window is flushed before it is closed, e.g. on shutdown
+	Unit        string    `json:"latency_unit"`
+	Count       uint64    `json:"total_requests"`
+	Mean        float64   `json:"avg_latency"`
+	Median      float64   `json:"median_latency"`
+	P95         float64   `json:"95_percentile"`
+	P99         float64   `json:"99_percentile"`
+	Min         float64   `json:"min_latency"`
+	Max         float64   `json:"max_latency"`
+
+	// RTT by TCP timestamps, it is written next to the latency to compare estimators, in Unit as well
+	TimestampCount  uint64  `json:"total_ts_samples,omitempty"`
+	TimestampMean   float64 `json:"avg_ts_rtt,omitempty"`
+	TimestampMedian float64 `json:"median_ts_rtt,omitempty"`
+	TimestampP95    float64 `json:"95_percentile_ts_rtt,omitempty"`
+	TimestampP99    float64 `json:"99_percentile_ts_rtt,omitempty"`
+	TimestampMin    float64 `json:"min_ts_rtt,omitempty"`
+	TimestampMax    float64 `json:"max_ts_rtt,omitempty"`
+
+	// time between mining.submit and the stratum response, in Unit as well
+	ProcessingCount  uint64  `json:"total_submits,omitempty"`
+	ProcessingMean   float64 `json:"avg_processing,omitempty"`
+	ProcessingMedian float64 `json:"median_processing,omitempty"`
+	ProcessingP95    float64 `json:"95_percentile_processing,omitempty"`
+	ProcessingP99    float64 `json:"99_percentile_processing,omitempty"`
+	ProcessingMax    float64 `json:"max_processing,omitempty"`
+
+	// time between SYN-ACK of the stratum and ACK of the miner for connections opened in the window, in Unit as well
+	HandshakeCount  uint64  `json:"total_handshakes,omitempty"`
+	HandshakeMedian float64 `json:"median_handshake_rtt,omitempty"`
+	HandshakeMin    float64 `json:"min_handshake_rtt,omitempty"`
+	HandshakeMax    float64 `json:"max_handshake_rtt,omitempty"`
+
+	// results of the submits by stratum responses, stale shares are not counted as rejected
+	SharesAccepted uint64            `json:"accepted_shares,omitempty"`
+	SharesStale    uint64            `json:"stale_shares,omitempty"`
+	SharesRejected uint64            `json:"rejected_shares,omitempty"`
+	RejectReasons  map[string]uint64 `json:"reject_reasons,omitempty"` // duplicate, low_difficulty, unauthorized, not_subscribed, rejected
+
+	// loss on the connections: retransmitted stratum segments and duplicate ACKs of the miner, rates are from 0 to 1.
+	// ACK of retransmitted segment gives no latency sample.
+	Segments       uint64  `json:"stratum_segments,omitempty"`
+	Retransmits    uint64  `json:"retransmitted_segments,omitempty"`
+	RetransmitRate float64 `json:"retransmit_rate,omitempty"`
+	MinerACKs      uint64  `json:"miner_acks,omitempty"`
+	DupACKs        uint64  `json:"duplicate_acks,omitempty"`
+	DupACKRate     float64 `json:"duplicate_ack_rate,omitempty"`
+	Resets         uint64  `json:"resets,omitempty"`
+	FINs           uint64  `json:"fins,omitempty"`
+
+	// churn of the connections: opened by SYN, closed by RST, FIN of both sides or the new connection from the address,
+	// reconnects are connections of the worker group opened after another one of its connections is closed or evicted
+	ConnectionsOpened uint64 `json:"opened_connections,omitempty"`
+	ConnectionsClosed uint64 `json:"closed_connections,omitempty"`
+	Reconnects        uint64 `json:"reconnects,omitempty"`
+
+	// mining.notify delivery from the first notify of the job to the miner ACK and spread from the first to the last ACK
+	// of the worker group miners, in Unit as well
+	NotifyJobs           uint64  `json:"notify_jobs,omitempty"`
+	NotifyDeliveryMedian float64 `json:"median_notify_delivery,omitempty"`
+	NotifyDeliveryP95    float64 `json:"95_percentile_notify_delivery,omitempty"`
+	NotifyDeliveryMax    float64 `json:"max_notify_delivery,omitempty"`
+	NotifySpreadMedian   float64 `json:"median_notify_spread,omitempty"`
+	NotifySpreadP95      float64 `json:"95_percentile_notify_spread,omitempty"`
+	NotifySpreadMax      float64 `json:"max_notify_spread,omitempty"`
+}
+
+// MarshalJSON omits latency fields of the result without latency samples, so zeros are not taken as latency
+func (r WindowResult) MarshalJSON() ([]byte, error) {
+	type result WindowResult // without MarshalJSON
+	if r.Count > 0 {
+		return json.Marshal(result(r))
+	}
+	// fields of the outer struct hide embedded ones with the same name and are omitted as empty
+	return json.Marshal(struct {
+		result
+		Count  uint64  `json:"total_requests,omitempty"`
+		Mean   float64 `json:"avg_latency,omitempty"`
+		Median float64 `json:"median_latency,omitempty"`
+		P95    float64 `json:"95_percentile,omitempty"`
+		P99    float64 `json:"99_percentile,omitempty"`
+		Min    float64 `json:"min_latency,omitempty"`
+		Max    float64 `json:"max_latency,omitempty"`
+	}{result: result(r)})
+}
+
+// Sink receives results of every closed window, all results of the window are passed in one call
+type Sink interface {
+	Write(ctx context.Context, results []WindowResult) error
+}
+
+// WithSinks replaces default log sink, pass NewLogSink explicitly to keep it
+func WithSinks(sinks ...Sink) Opt {
+	return func(s *Service) {
+		s.sinks = sinks
+	}
+}
+
+// LogSink writes "miner latency" log line per result, it is the default sink. Result without latency samples is
+// written as "miner stats" line without latency fields.
+type LogSink struct {
+	l logger.AppLogger
+}
+
+func NewLogSink(l logger.AppLogger) *LogSink {
+	return &LogSink{l: l}
+}
+
+func (s *LogSink) Write(_ context.Context, results []WindowResult) error {
+	for i := range results {
+		r := &results[i]
+		l := s.l
+		if r.Partial {
+			l = l.With(slog.Bool("partial", true)) // keep log lines of closed windows as they were
+		}
+		if r.TimestampCount > 0 {
+			l = l.With(
+				slog.Int64("total_ts_samples", int64(r.TimestampCount)),
+				slog.Float64("avg_ts_rtt", r.TimestampMean),
+				slog.Float64("95_percentile_ts_rtt", r.TimestampP95),
+				slog.Float64("99_percentile_ts_rtt", r.TimestampP99),
+				slog.Float64("median_ts_rtt", r.TimestampMedian),
+				slog.Float64("max_ts_rtt", r.TimestampMax),
+				slog.Float64("min_ts_rtt", r.TimestampMin),
+			)
+		}
+		if r.HandshakeCount > 0 {
+			l = l.With(
+				slog.Int64("total_handshakes", int64(r.HandshakeCount)),
+				slog.Float64("median_handshake_rtt", r.HandshakeMedian),
+				slog.Float64("min_handshake_rtt", r.HandshakeMin),
+				slog.Float64("max_handshake_rtt", r.HandshakeMax),
+			)
+		}
+		if r.SharesAccepted+r.SharesStale+r.SharesRejected > 0 {
+			l = l.With(
+				slog.Int64("accepted_shares", int64(r.SharesAccepted)),
+				slog.Int64("stale_shares", int64(r.SharesStale)),
+				slog.Int64("rejected_shares", int64(r.SharesRejected)),
+			)
+			if len(r.RejectReasons) > 0 {
+				l = l.With(slog.Any("reject_reasons", r.RejectReasons))
+			}
+		}
+		if r.Retransmits+r.DupACKs+r.Resets > 0 {
+			l = l.With(
+				slog.Int64("stratum_segments", int64(r.Segments)),
+				slog.Int64("retransmitted_segments", int64(r.Retransmits)),
+				slog.Float64("retransmit_rate", r.RetransmitRate),
+				slog.Int64("miner_acks", int64(r.MinerACKs)),
+				slog.Int64("duplicate_acks", int64(r.DupACKs)),
+				slog.Float64("duplicate_ack_rate", r.DupACKRate),
+				slog.Int64("resets", int64(r.Resets)),
+				slog.Int64("fins", int64(r.FINs)),
+			)
+		}
+		if r.ConnectionsOpened+r.ConnectionsClosed+r.Reconnects > 0 {
+			l = l.With(
+				slog.Int64("opened_connections", int64(r.ConnectionsOpened)),
+				slog.Int64("closed_connections", int64(r.ConnectionsClosed)),
+				slog.Int64("reconnects", int64(r.Reconnects)),
+			)
+		}
+		if r.NotifyJobs > 0 {
+			l = l.With(
+				slog.Int64("notify_jobs", int64(r.NotifyJobs)),
+				slog.Float64("median_notify_delivery", r.NotifyDeliveryMedian),
+				slog.Float64("95_percentile_notify_delivery", r.NotifyDeliveryP95),
+				slog.Float64("max_notify_delivery", r.NotifyDeliveryMax),
+				slog.Float64("median_notify_spread", r.NotifySpreadMedian),
+				slog.Float64("95_percentile_notify_spread", r.NotifySpreadP95),
+				slog.Float64("max_notify_spread", r.NotifySpreadMax),
+			)
+		}
+		if r.ProcessingCount > 0 {
+			l = l.With(
+				slog.Int64("total_submits", int64(r.ProcessingCount)),
+				slog.Float64("avg_processing", r.ProcessingMean),
+				slog.Float64("95_percentile_processing", r.ProcessingP95),
+				slog.Float64("99_percentile_processing", r.ProcessingP99),
+				slog.Float64("median_processing", r.ProcessingMedian),
+				slog.Float64("max_processing", r.ProcessingMax),
+			)
+		}
+		l = l.With(
+			slog.String("observe_interval", r.Interval.Format(time.DateTime)),
+			logger.WithWorkerGroup(r.WorkerGroup),
+			slog.String("mining_coin", r.Coin),
+		)
+		if r.Count == 0 {
+			// no latency samples, zeros would be taken as latency by consumers of the "miner latency" line
+			l.With(logger.WithNetworkConnectionType(entities.MinerExchangeDataWithStratum)).Info("miner stats")
+			continue
+		}
+		l.With(
+			slog.Int64("total_requests", int64(r.Count)),
+			slog.Float64("avg_latency", r.Mean),
+			slog.Float64("95_percentile", r.P95),
+			slog.Float64("99_percentile", r.P99),
+			slog.Float64("median_latency", r.Median),
+			slog.Float64("max_latency", r.Max),
+			slog.Float64("min_latency", r.Min),
+			slog.String("latency_unit", r.Unit),
+			logger.WithLatencyFlag(),
+			logger.WithNetworkConnectionType(entities.MinerExchangeDataWithStratum),
+		).Info("miner latency")
+	}
+	return nil
+}
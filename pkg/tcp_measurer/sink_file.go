@@ -0,0 +1,43 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// JSONLinesSink appends every result as json line to the file.
+// File is reopened on every write, so it can be rotated by logrotate without signals.
+type JSONLinesSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewJSONLinesSink(path string) *JSONLinesSink {
+	return &JSONLinesSink{path: path}
+}
+
+func (s *JSONLinesSink) Write(_ context.Context, results []WindowResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open results file: %w", err)
+	}
+	buf := bufio.NewWriter(file)
+	enc := json.NewEncoder(buf)
+	for i := range results {
+		if err = enc.Encode(&results[i]); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to encode result: %w", err)
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write results file: %w", err)
+	}
+	return file.Close()
+}
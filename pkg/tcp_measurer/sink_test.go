@@ -0,0 +1,189 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/Taal_Orchestrator/orca-std-go/logger"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSink struct {
+	mu      sync.Mutex
+	results [][]WindowResult
+	err     error
+}
+
+func (s *recordingSink) Write(_ context.Context, results []WindowResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results = append(s.results, results)
+	return s.err
+}
+
+// written returns results of all writes in order
+func (s *recordingSink) written() []WindowResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var written []WindowResult
+	for _, results := range s.results {
+		written = append(written, results...)
+	}
+	return written
+}
+
+func TestService_ProcessData_Sinks(t *testing.T) {
+	// given
+	var (
+		webhookMU      sync.Mutex
+		webhookResults []WindowResult
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		webhookMU.Lock()
+		defer webhookMU.Unlock()
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&webhookResults))
+	}))
+	defer webhook.Close()
+	resultsFile := filepath.Join(t.TempDir(), "results.jsonl")
+	failing := &recordingSink{err: errors.New("sink is down")}
+	recording := &recordingSink{}
+	srv := newTestService(t,
+		WithLatencyUnit(time.Microsecond),
+		WithSinks(failing, NewJSONLinesSink(resultsFile), NewWebhookSink(webhook.URL, time.Second), recording),
+	)
+	require.NoError(t, srv.ReadFilePureGO("samples/fixture-sll.pcap"))
+
+	// when
+	srv.observeEventTime(time.Date(2024, 5, 31, 13, 46, 0, 0, time.UTC)) // closes 13:40 window
+	srv.DumpIt()
+
+	// then
+	require.Len(t, recording.results, 1, "failed sink should not stop others")
+	results := recording.results[0]
+	require.Len(t, results, 3)
+	interval := time.Date(2024, 5, 31, 13, 40, 0, 0, time.UTC)
+	expected := []struct {
+		workerGroup string
+		count       uint64
+		min, max    float64
+	}{
+		{workerGroup: "lp-wg3-s19jpro.cos-pb11-r4a2-96", count: 7, min: 32093, max: 32954},
+		{workerGroup: "lp-wg5-s19jpro.cos-pb13-r1f6-100", count: 8, min: 31087, max: 71306},
+		{workerGroup: "sfm-wg3-m30s++.CA040A00098F", count: 9, min: 63280, max: 64256},
+	}
+	for i, e := range expected {
+		r := results[i]
+		require.Equal(t, e.workerGroup, r.WorkerGroup)
+		require.Equal(t, "BSV", r.Coin)
+		require.Equal(t, "us", r.Unit)
+		require.True(t, interval.Equal(r.Interval), r.Interval.String())
+		require.Equal(t, e.count, r.Count)
+		require.Equal(t, e.min, r.Min)
+		require.Equal(t, e.max, r.Max)
+		require.True(t, r.Min <= r.Median && r.Median <= r.P95 && r.P95 <= r.P99 && r.P99 <= r.Max, "%+v", r)
+		require.True(t, r.Min <= r.Mean && r.Mean <= r.Max, "%+v", r)
+	}
+
+	file, err := os.Open(resultsFile)
+	require.NoError(t, err)
+	defer file.Close()
+	var fileResults []WindowResult
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r WindowResult
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		fileResults = append(fileResults, r)
+	}
+	require.Len(t, fileResults, len(results))
+	webhookMU.Lock()
+	defer webhookMU.Unlock()
+	require.Len(t, webhookResults, len(results))
+	for i := range results {
+		require.True(t, results[i].Interval.Equal(fileResults[i].Interval))
+		require.True(t, results[i].Interval.Equal(webhookResults[i].Interval))
+		fileResults[i].Interval, webhookResults[i].Interval = results[i].Interval, results[i].Interval
+	}
+	require.Equal(t, results, fileResults)
+	require.Equal(t, results, webhookResults)
+}
+
+func TestJSONLinesSink_Append(t *testing.T) {
+	resultsFile := filepath.Join(t.TempDir(), "results.jsonl")
+	sink := NewJSONLinesSink(resultsFile)
+	result := WindowResult{WorkerGroup: "wg1", Coin: "BSV", Unit: "ms", Count: 1, Mean: 0.25}
+	require.NoError(t, sink.Write(context.Background(), []WindowResult{result}))
+	require.NoError(t, os.Rename(resultsFile, resultsFile+".1")) // rotated
+	require.NoError(t, sink.Write(context.Background(), []WindowResult{result, result}))
+
+	data, err := os.ReadFile(resultsFile)
+	require.NoError(t, err)
+	line := `{"worker_group":"wg1","mining_coin":"BSV","observe_interval":"0001-01-01T00:00:00Z","partial":false,"latency_unit":"ms","total_requests":1,"avg_latency":0.25,"median_latency":0,"95_percentile":0,"99_percentile":0,"min_latency":0,"max_latency":0}` + "\n"
+	require.Equal(t, line+line, string(data))
+
+	require.Error(t, NewJSONLinesSink(t.TempDir()).Write(context.Background(), []WindowResult{result}))
+}
+
+func TestWebhookSink_Status(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	err := NewWebhookSink(server.URL, time.Second).Write(context.Background(), []WindowResult{{WorkerGroup: "wg1"}})
+	require.ErrorContains(t, err, "status 502")
+}
+
+func TestLogSink_WithoutLatency(t *testing.T) {
+	// given
+	var buf bytes.Buffer
+	appLogger, err := logger.NewAppSLogger(&logger.Config{Progname: "orca_mapicron", Writers: []io.Writer{&buf}}, "")
+	require.NoError(t, err)
+	srv := newTestService(t, WithSinks(NewLogSink(appLogger), NewJSONLinesSink(filepath.Join(t.TempDir(), "results.jsonl"))))
+	at := time.Date(2024, 5, 31, 13, 41, 0, 0, time.UTC)
+	submit := testSegment{
+		src:     testMiner,
+		dst:     testStratum,
+		seq:     2396494688,
+		ack:     3568706784,
+		flags:   tcpFlagACK | tcpFlagPSH,
+		payload: []byte(`{"params": ["lp-wg4-s19jpro.cos-pb12-r7b1-96", "BSV-846861-89d48", "00000000"], "id": 171118, "method": "mining.submit"}`),
+	}
+
+	// when
+	replaySegments(t, srv, at, submit)
+	replaySegments(t, srv, at.Add(time.Millisecond), testResponse(testStratum, testMiner)) // never acknowledged
+	srv.flushAll()
+
+	// then
+	var lines []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal(line, &fields))
+		if fields["worker_group"] != nil {
+			lines = append(lines, fields)
+		}
+	}
+	require.Len(t, lines, 1)
+	require.Equal(t, "miner stats", lines[0]["msg"], "window without latency samples gives no miner latency line")
+	require.Equal(t, float64(1), lines[0]["accepted_shares"])
+	require.Equal(t, float64(1), lines[0]["total_submits"])
+	for _, field := range []string{"total_requests", "avg_latency", "median_latency", "95_percentile", "99_percentile", "min_latency", "max_latency"} {
+		require.NotContains(t, lines[0], field)
+	}
+
+	data, err := json.Marshal(WindowResult{WorkerGroup: "wg1", Unit: "ms", SharesAccepted: 1, Segments: 1, MinerACKs: 1})
+	require.NoError(t, err)
+	require.Equal(t, `{"worker_group":"wg1","mining_coin":"","observe_interval":"0001-01-01T00:00:00Z","partial":false,"latency_unit":"ms","accepted_shares":1,"stratum_segments":1,"miner_acks":1}`, string(data))
+}
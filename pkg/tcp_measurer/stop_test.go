@@ -0,0 +1,87 @@
+package tcpmeasurer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Stop(t *testing.T) {
+	// given
+	filesPath := t.TempDir()
+	fixture, err := os.ReadFile("samples/fixture-sll.pcap")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(filesPath, "caapture-1.pcap"), fixture, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(filesPath, "caapture-2.pcap"), fixture, 0o600)) // tcpdump outside of service still writes it
+	sink := &recordingSink{}
+	srv := newTestService(t,
+		WithSkipCMD("1"),
+		WithFilesPath(filesPath),
+		WithParseFilesInterval(time.Hour),
+		WithSinks(sink),
+	)
+	require.NoError(t, srv.Start())
+
+	// when
+	srv.Stop()
+	srv.Stop()
+
+	// then
+	results := sink.written()
+	require.Len(t, results, 3, "windows of the drained file should be flushed once")
+	counts := make(map[string]uint64, len(results))
+	for _, result := range results {
+		require.True(t, result.Partial)
+		counts[result.WorkerGroup] = result.Count
+	}
+	require.Equal(t, map[string]uint64{
+		"lp-wg3-s19jpro.cos-pb11-r4a2-96":  7,
+		"lp-wg5-s19jpro.cos-pb13-r1f6-100": 8,
+		"sfm-wg3-m30s++.CA040A00098F":      9,
+	}, counts)
+	_, err = os.Stat(filepath.Join(filesPath, "caapture-1.pcap"))
+	require.True(t, os.IsNotExist(err), "drained file should be removed")
+	_, err = os.Stat(filepath.Join(filesPath, "caapture-2.pcap"))
+	require.NoError(t, err, "file which is being written should be kept")
+}
+
+func TestService_Stop_Tcpdump(t *testing.T) {
+	// given
+	binPath, filesPath := t.TempDir(), t.TempDir()
+	fixture, err := filepath.Abs("samples/fixture-sll.pcap")
+	require.NoError(t, err)
+	// sudo waits for the command as the real one does, tcpdump writes the capture file only when it is stopped
+	scripts := map[string]string{
+		"sudo":    "#!/bin/sh\ntrap : TERM\n\"$@\"\n",
+		"tcpdump": "#!/bin/sh\ntrap 'sleep 0.2; cp " + fixture + " " + filesPath + "/caapture-1.pcap; exit 0' TERM\ntouch " + binPath + "/started\nwhile :; do sleep 0.05; done\n",
+	}
+	for name, script := range scripts {
+		require.NoError(t, os.WriteFile(filepath.Join(binPath, name), []byte(script), 0o700))
+	}
+	t.Setenv("PATH", binPath+string(os.PathListSeparator)+os.Getenv("PATH"))
+	sink := &recordingSink{}
+	srv := newTestService(t,
+		WithCustomApp("tcpdump"),
+		WithFilesPath(filesPath),
+		WithParseFilesInterval(time.Hour),
+		WithSinks(sink),
+	)
+	go func() {
+		_ = srv.Start()
+	}()
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(binPath, "started"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// when
+	srv.Stop()
+
+	// then
+	require.Len(t, sink.written(), 3, "file flushed by tcpdump on stop should be drained")
+	_, err = os.Stat(filepath.Join(filesPath, "caapture-1.pcap"))
+	require.True(t, os.IsNotExist(err), "drained file should be removed")
+}
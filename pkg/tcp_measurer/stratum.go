@@ -0,0 +1,361 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// stratum v1 is newline delimited JSON-RPC, miner sends requests
+//
+//	{"id": 1, "method": "mining.authorize", "params": ["worker", "password"]}
+//	{"params": ["worker", "BSV-846861-89d48", "00000000", "6659d4b4", "9c2d0a5e"], "id": 171118, "method": "mining.submit"}
+//
+// Key order and spaces depend on the miner firmware. Captured segment may contain several messages
+// or only part of the message, it is cut by snap length or continues in the next segment.
+
+const (
+	stratumMethodAuthorize = "mining.authorize"
+	stratumMethodSubmit    = "mining.submit"
+	stratumMethodNotify    = "mining.notify"
+
+	// mining.submit has 5 params, 6 with version rolling, values after the limit are counted but not kept
+	stratumMaxParams = 8
+)
+
+var (
+	errMalformedStratum = errors.New("malformed stratum message")
+	errTruncatedStratum = errors.New("truncated stratum message")
+)
+
+// stratumValue is raw json value which references the payload, strings are without quotes and are not unescaped
+type stratumValue struct {
+	raw       []byte
+	str       bool
+	truncated bool // payload ends inside of the value
+}
+
+func (v stratumValue) isString() bool {
+	return v.str && !v.truncated
+}
+
+// stratumMessage keeps top level fields of the message, params are kept up to stratumMaxParams
+type stratumMessage struct {
+	id        stratumValue
+	method    stratumValue
+	result    stratumValue
+	err       stratumValue
+	reason    stratumValue // "reject-reason" of the response, some pools set it instead of error
+	params    [stratumMaxParams]stratumValue
+	paramsLen int
+	truncated bool // payload ends before the message is closed, fields after it are not known
+}
+
+func (m *stratumMessage) param(i int) stratumValue {
+	if i >= m.paramsLen || i >= stratumMaxParams {
+		return stratumValue{}
+	}
+	return m.params[i]
+}
+
+// hasID is true for requests and responses, notifications have null id
+func (m *stratumMessage) hasID() bool {
+	return m.id.raw != nil && !m.id.truncated && (m.id.str || string(m.id.raw) != "null")
+}
+
+func (m *stratumMessage) isMethod(method string) bool {
+	return m.method.isString() && string(m.method.raw) == method
+}
+
+// worker returns worker name from mining.authorize and mining.submit, both have it as the first param.
+// If message is truncated before the method, params are expected to be of mining.submit, such worker is not definitive.
+func (m *stratumMessage) worker() (worker []byte, definitive bool) {
+	name := m.param(0)
+	if !name.isString() || len(name.raw) == 0 {
+		return nil, false
+	}
+	switch {
+	case m.isMethod(stratumMethodAuthorize), m.isMethod(stratumMethodSubmit):
+		return name.raw, true
+	case m.method.raw == nil && m.truncated:
+		return name.raw, false
+	}
+	return nil, false
+}
+
+// jobID returns job id of mining.submit, it is the second param and may be truncated
+func (m *stratumMessage) jobID() []byte {
+	if m.method.raw != nil && !m.isMethod(stratumMethodSubmit) {
+		return nil
+	}
+	if job := m.param(1); job.str {
+		return job.raw
+	}
+	return nil
+}
+
+// nextStratumMessage parses the first message of the payload into msg and returns the rest of the payload.
+// Line which does not start with object is continuation of the previous segment, it is skipped with ok false
+// as well as malformed messages. Last line without newline is parsed as truncated message.
+func nextStratumMessage(payload []byte, msg *stratumMessage) (rest []byte, ok bool) {
+	line := payload
+	if end := bytes.IndexByte(payload, '\n'); end >= 0 {
+		line, rest = payload[:end], payload[end+1:]
+	}
+	*msg = stratumMessage{}
+	err := msg.parse(line)
+	if errors.Is(err, errTruncatedStratum) && rest == nil {
+		msg.truncated = true
+		return rest, true
+	}
+	return rest, err == nil
+}
+
+func (m *stratumMessage) parse(line []byte) error {
+	sc := stratumScanner{data: line}
+	sc.skipSpace()
+	if !sc.consume('{') {
+		return errMalformedStratum
+	}
+	for first := true; ; first = false {
+		sc.skipSpace()
+		if sc.consume('}') {
+			return nil
+		}
+		if !first && !sc.consume(',') {
+			return sc.unexpected()
+		}
+		sc.skipSpace()
+		key, err := sc.value()
+		if err != nil {
+			return err
+		}
+		if !key.str {
+			return errMalformedStratum
+		}
+		sc.skipSpace()
+		if !sc.consume(':') {
+			return sc.unexpected()
+		}
+		sc.skipSpace()
+		switch string(key.raw) {
+		case "params":
+			err = m.parseParams(&sc)
+		case "id":
+			m.id, err = sc.value()
+		case "method":
+			m.method, err = sc.value()
+		case "result":
+			m.result, err = sc.value()
+		case "error":
+			m.err, err = sc.value()
+		case "reject-reason":
+			m.reason, err = sc.value()
+		default:
+			_, err = sc.value()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *stratumMessage) parseParams(sc *stratumScanner) error {
+	if !sc.consume('[') {
+		_, err := sc.value() // e.g. null, keep params empty
+		return err
+	}
+	for first := true; ; first = false {
+		sc.skipSpace()
+		if sc.consume(']') {
+			return nil
+		}
+		if !first && !sc.consume(',') {
+			return sc.unexpected()
+		}
+		sc.skipSpace()
+		v, err := sc.value()
+		if v.raw != nil || v.truncated {
+			if m.paramsLen < stratumMaxParams {
+				m.params[m.paramsLen] = v
+			}
+			m.paramsLen++
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stratumScanner walks json without decoding it, nested values are skipped as raw bytes
+type stratumScanner struct {
+	data []byte
+	pos  int
+}
+
+func (sc *stratumScanner) skipSpace() {
+	for sc.pos < len(sc.data) {
+		switch sc.data[sc.pos] {
+		case ' ', '\t', '\r', '\n':
+			sc.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (sc *stratumScanner) consume(c byte) bool {
+	if sc.pos < len(sc.data) && sc.data[sc.pos] == c {
+		sc.pos++
+		return true
+	}
+	return false
+}
+
+// unexpected is error for the current position, end of data means the message is truncated
+func (sc *stratumScanner) unexpected() error {
+	if sc.pos >= len(sc.data) {
+		return errTruncatedStratum
+	}
+	return errMalformedStratum
+}
+
+// value scans any json value, truncated string or number is returned with errTruncatedStratum
+func (sc *stratumScanner) value() (stratumValue, error) {
+	if sc.pos >= len(sc.data) {
+		return stratumValue{}, errTruncatedStratum
+	}
+	start := sc.pos
+	switch sc.data[sc.pos] {
+	case '"':
+		end, err := sc.skipString()
+		if err != nil {
+			return stratumValue{raw: sc.data[start+1:], str: true, truncated: true}, err
+		}
+		return stratumValue{raw: sc.data[start+1 : end-1], str: true}, nil
+	case '{', '[':
+		if err := sc.skipNested(); err != nil {
+			return stratumValue{raw: sc.data[start:], truncated: true}, err
+		}
+		return stratumValue{raw: sc.data[start:sc.pos]}, nil
+	case ',', ':', ']', '}':
+		return stratumValue{}, errMalformedStratum
+	}
+	for sc.pos < len(sc.data) {
+		switch sc.data[sc.pos] {
+		case ',', ']', '}', ' ', '\t', '\r':
+			return stratumValue{raw: sc.data[start:sc.pos]}, nil
+		case '"', '{', '[', ':':
+			return stratumValue{}, errMalformedStratum
+		}
+		sc.pos++
+	}
+	return stratumValue{raw: sc.data[start:], truncated: true}, errTruncatedStratum
+}
+
+// skipString moves position after the closing quote of the string which starts at the position
+func (sc *stratumScanner) skipString() (end int, err error) {
+	for sc.pos++; sc.pos < len(sc.data); sc.pos++ {
+		switch sc.data[sc.pos] {
+		case '\\':
+			sc.pos++
+		case '"':
+			sc.pos++
+			return sc.pos, nil
+		}
+	}
+	sc.pos = len(sc.data)
+	return 0, errTruncatedStratum
+}
+
+// skipNested moves position after the object or array which starts at the position
+func (sc *stratumScanner) skipNested() error {
+	depth := 0
+	for sc.pos < len(sc.data) {
+		switch sc.data[sc.pos] {
+		case '"':
+			if _, err := sc.skipString(); err != nil {
+				return err
+			}
+			continue
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				sc.pos++
+				return nil
+			}
+		}
+		sc.pos++
+	}
+	return errTruncatedStratum
+}
+
+// ExtractWorkerGroup returns worker name and coin of the first mining.authorize or mining.submit in the payload.
+// Coin is detected by built-in job id prefixes only, it is empty for other coins, see Service.ExtractWorkerGroup
+// for the coin the service outputs.
+func ExtractWorkerGroup(payload []byte) (workerGroup, coin string) {
+	return extractWorkerGroup(payload, defaultCoinRules, 0)
+}
+
+// ExtractWorkerGroup returns worker name and coin of the first mining.authorize or mining.submit in the payload,
+// coin is classified by rules of the service and default coin is returned if no rule matches
+func (s *Service) ExtractWorkerGroup(payload []byte) (workerGroup, coin string) {
+	workerGroup, coin = extractWorkerGroup(payload, s.coinRules, uint16(s.observePort))
+	if workerGroup != "" && coin == "" {
+		coin = s.defaultCoin
+	}
+	return workerGroup, coin
+}
+
+func extractWorkerGroup(payload []byte, rules []CoinRule, stratumPort uint16) (workerGroup, coin string) {
+	var msg stratumMessage
+	for rest := payload; len(rest) > 0; {
+		var ok bool
+		if rest, ok = nextStratumMessage(rest, &msg); !ok {
+			continue
+		}
+		if worker, _ := msg.worker(); worker != nil {
+			return string(worker), classifyCoin(rules, worker, msg.jobID(), stratumPort)
+		}
+	}
+	return "", ""
+}
+
+// processMinerPayload maps miner connection to the worker group and remembers submits to match them with responses.
+// nextSeq is sequence number after the segment, stratum acknowledges it with the response.
+func (s *shard) processMinerPayload(key connKey, stratumPort uint16, eventTime time.Time, nextSeq uint32, payload []byte) {
+	var msg stratumMessage
+	for rest := payload; len(rest) > 0; {
+		var ok bool
+		if rest, ok = nextStratumMessage(rest, &msg); !ok {
+			continue
+		}
+		s.identifyMiner(key, stratumPort, eventTime, &msg)
+		s.trackSubmit(key, eventTime, nextSeq, &msg)
+	}
+}
+
+// identifyMiner maps miner connection to the worker group. Worker of truncated message does not override
+// known one, so connection is not remapped by the message which only looks like mining.submit.
+func (s *shard) identifyMiner(key connKey, stratumPort uint16, eventTime time.Time, msg *stratumMessage) {
+	worker, definitive := msg.worker()
+	if worker == nil {
+		return
+	}
+	knownWorker, knownCoin := s.matchedMiners[key], s.matchedMinersCoin[key]
+	sameWorker := knownWorker == string(worker)
+	switch {
+	case knownWorker == "", definitive && !sameWorker:
+		coin := classifyCoin(s.coinRules, worker, msg.jobID(), stratumPort)
+		s.matchedMiners[key] = string(worker)
+		s.matchedMinersCoin[key] = coin
+		s.mapConnection(eventTime, key, string(worker))
+	case sameWorker && knownCoin == "":
+		// mining.authorize has no job id, coin may come with the first share
+		if coin := classifyCoin(s.coinRules, worker, msg.jobID(), stratumPort); coin != "" {
+			s.matchedMinersCoin[key] = coin
+		}
+	}
+}
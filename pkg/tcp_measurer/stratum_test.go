@@ -0,0 +1,197 @@
+package tcpmeasurer
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNextStratumMessage(t *testing.T) {
+	table := map[string]struct {
+		payload   string
+		ok        bool
+		id        string
+		method    string
+		params    []string
+		truncated bool
+		rest      string
+	}{
+		"submit params first": {
+			payload: `{"params": ["wg1.rig", "BSV-846861-89d48", "00000000", "6659d4b4", "9c2d0a5e"], "id": 171118, "method": "mining.submit"}` + "\n",
+			ok:      true,
+			id:      "171118",
+			method:  "mining.submit",
+			params:  []string{"wg1.rig", "BSV-846861-89d48", "00000000", "6659d4b4", "9c2d0a5e"},
+		},
+		"submit method first without spaces": {
+			payload: `{"id":5,"method":"mining.submit","params":["wg1.rig","BCH-1","00","01","02","1fffe000"]}` + "\n",
+			ok:      true,
+			id:      "5",
+			method:  "mining.submit",
+			params:  []string{"wg1.rig", "BCH-1", "00", "01", "02", "1fffe000"},
+		},
+		"authorize with string id and escapes": {
+			payload: "{ \"id\" : \"auth\\\"1\" ,\t\"params\" : [ \"wg\\\\1\" , \"x\" ] , \"method\" : \"mining.authorize\" }\r\n",
+			ok:      true,
+			id:      `auth\"1`,
+			method:  "mining.authorize",
+			params:  []string{`wg\\1`, "x"},
+		},
+		"configure with nested params": {
+			payload: `{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"1fffe000","x":[1,{"y":"]"}]}]}` + "\n",
+			ok:      true,
+			id:      "1",
+			method:  "mining.configure",
+			params:  []string{`["version-rolling"]`, `{"version-rolling.mask":"1fffe000","x":[1,{"y":"]"}]}`},
+		},
+		"coalesced messages": {
+			payload: `{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}` + "\n" + `{"id":3,"method":"mining.authorize","params":["wg1.rig","x"]}` + "\n",
+			ok:      true,
+			id:      "2",
+			method:  "mining.subscribe",
+			params:  []string{"bmminer/2.0.0"},
+			rest:    `{"id":3,"method":"mining.authorize","params":["wg1.rig","x"]}` + "\n",
+		},
+		"truncated by snap length": {
+			payload:   `{"params": ["wg1.rig", "BSV-846861-8`,
+			ok:        true,
+			params:    []string{"wg1.rig", "BSV-846861-8"},
+			truncated: true,
+		},
+		"truncated after key": {
+			payload:   `{"id": 7, "method"`,
+			ok:        true,
+			id:        "7",
+			truncated: true,
+		},
+		"continuation of previous segment": {
+			payload: `"00000000"], "id": 171118, "method": "mining.submit"}` + "\n" + `{"id":4,"method":"mining.submit","params":["wg1.rig"]}`,
+			rest:    `{"id":4,"method":"mining.submit","params":["wg1.rig"]}`,
+		},
+		"truncated in the middle of payload": {
+			payload: `{"id":4,"method":"mining.submit","params":["wg1.rig"` + "\n" + `{}`,
+			rest:    `{}`,
+		},
+		"null params": {
+			payload: `{"id":1,"result":true,"error":null,"params":null}`,
+			ok:      true,
+			id:      "1",
+		},
+		"malformed": {
+			payload: `{"id":1,,"method":"mining.submit"}`,
+		},
+		"not an object": {
+			payload: `["mining.submit"]`,
+		},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			var msg stratumMessage
+			rest, ok := nextStratumMessage([]byte(tc.payload), &msg)
+			require.Equal(t, tc.ok, ok)
+			require.Equal(t, tc.rest, string(rest))
+			if !tc.ok {
+				return
+			}
+			require.Equal(t, tc.id, string(msg.id.raw))
+			require.Equal(t, tc.method, string(msg.method.raw))
+			require.Equal(t, tc.truncated, msg.truncated)
+			require.Equal(t, len(tc.params), msg.paramsLen)
+			for i, param := range tc.params {
+				require.Equal(t, param, string(msg.param(i).raw))
+			}
+		})
+	}
+}
+
+func TestStratumMessage_Worker(t *testing.T) {
+	table := map[string]struct {
+		payload    string
+		worker     string
+		definitive bool
+		coin       string
+	}{
+		"authorize":                 {payload: `{"id":3,"method":"mining.authorize","params":["wg1.rig","x"]}`, worker: "wg1.rig", definitive: true},
+		"submit":                    {payload: `{"id":3,"method":"mining.submit","params":["wg1.rig","BCH-1"]}`, worker: "wg1.rig", definitive: true, coin: "BCH"},
+		"submit without coin":       {payload: `{"id":3,"method":"mining.submit","params":["wg1.rig","6659d4b4"]}`, worker: "wg1.rig", definitive: true},
+		"truncated before method":   {payload: `{"params": ["wg1.rig", "BSV-84`, worker: "wg1.rig", coin: "BSV"},
+		"truncated worker":          {payload: `{"params": ["wg1.ri`},
+		"truncated method":          {payload: `{"params": ["wg1.rig", "BSV-1"], "method": "mining.sub`},
+		"subscribe":                 {payload: `{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}`},
+		"suggest difficulty":        {payload: `{"id":2,"method":"mining.suggest_difficulty","params":[1024]}`},
+		"empty worker":              {payload: `{"id":3,"method":"mining.authorize","params":["","x"]}`},
+		"stratum response":          {payload: `{"id":171118,"result":true,"error":null}`},
+		"notification from stratum": {payload: `{"id":null,"method":"mining.set_difficulty","params":[8192]}`},
+	}
+	for name, tc := range table {
+		t.Run(name, func(t *testing.T) {
+			var msg stratumMessage
+			_, ok := nextStratumMessage([]byte(tc.payload), &msg)
+			require.True(t, ok)
+			worker, definitive := msg.worker()
+			require.Equal(t, tc.worker, string(worker))
+			require.Equal(t, tc.definitive, definitive)
+			require.Equal(t, tc.coin, classifyCoin(defaultCoinRules, worker, msg.jobID(), 3333))
+		})
+	}
+}
+
+func TestService_IdentifyMiner(t *testing.T) {
+	srv := newTestService(t)
+	key := connKey{miner: testMiner, stratum: testStratum}
+
+	srv.shards[0].processMinerPayload(key, 3333, time.Time{}, 0, []byte(`{"params": ["bmminer/2.0.0", "BSV-1`)) // looks like truncated mining.submit
+	require.Equal(t, "bmminer/2.0.0", srv.shards[0].matchedMiners[key])
+	require.Equal(t, "BSV", srv.shards[0].matchedMinersCoin[key])
+
+	srv.shards[0].processMinerPayload(key, 3333, time.Time{}, 0, []byte(`{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}`+"\n"+`{"id":3,"method":"mining.authorize","params":["wg1.rig","x"]}`+"\n"))
+	require.Equal(t, "wg1.rig", srv.shards[0].matchedMiners[key], "definitive worker replaces guessed one")
+	require.Equal(t, "", srv.shards[0].matchedMinersCoin[key])
+
+	srv.shards[0].processMinerPayload(key, 3333, time.Time{}, 0, []byte(`{"params": ["wg2.rig", "BSV-1`))
+	require.Equal(t, "wg1.rig", srv.shards[0].matchedMiners[key], "guessed worker does not replace known one")
+	require.Equal(t, "", srv.shards[0].matchedMinersCoin[key])
+
+	srv.shards[0].processMinerPayload(key, 3333, time.Time{}, 0, []byte(`{"id":4,"method":"mining.submit","params":["wg1.rig","BSV-846861-89d48","00000000","6659d4b4","9c2d0a5e"]}`+"\n"))
+	require.Equal(t, "wg1.rig", srv.shards[0].matchedMiners[key])
+	require.Equal(t, "BSV", srv.shards[0].matchedMinersCoin[key], "coin comes with the first share")
+	require.Len(t, srv.shards[0].matchedMiners, 1)
+}
+
+func TestNextStratumMessage_Allocs(t *testing.T) {
+	payload := []byte(`{"id":2,"method":"mining.subscribe","params":["bmminer/2.0.0"]}` + "\n" +
+		`{"id":4,"method":"mining.submit","params":["wg1.rig","BSV-846861-89d48","00000000","6659d4b4","9c2d0a5e"]}` + "\n" +
+		`{"params": ["wg1.rig", "BSV-846861-8`)
+	allocs := testing.AllocsPerRun(100, func() {
+		var msg stratumMessage
+		for rest := payload; len(rest) > 0; {
+			rest, _ = nextStratumMessage(rest, &msg)
+			msg.worker()
+			msg.jobID()
+		}
+	})
+	require.Zero(t, allocs)
+}
+
+func FuzzNextStratumMessage(f *testing.F) {
+	f.Add([]byte(`{"params": ["lp-wg4-s19jpro.cos-pb12-r7b1-96", "BSV-846861-89d48", "00000000"], "id": 171118, "method": "mining.submit"}` + "\n"))
+	f.Add([]byte(`{"id":1,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"1fffe000"}]}` + "\n" + `{"id":2,"meth`))
+	f.Add([]byte(`{"id":"a\"b","params":["w\\"]}`))
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var msg stratumMessage
+		for rest := payload; len(rest) > 0; {
+			next, _ := nextStratumMessage(rest, &msg)
+			require.Less(t, len(next), len(rest))
+			rest = next
+			for _, v := range []stratumValue{msg.id, msg.method, msg.param(0), msg.param(1)} {
+				if len(v.raw) > 0 {
+					require.True(t, bytes.Contains(payload, v.raw))
+				}
+			}
+			msg.worker()
+			msg.jobID()
+		}
+	})
+}
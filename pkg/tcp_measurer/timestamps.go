@@ -0,0 +1,50 @@
+package tcpmeasurer
+
+import "time"
+
+// RTT by TCP timestamps (RFC 7323): miner echoes TSval of the stratum segment in TSecr, so the first miner segment which
+// echoes the value gives RTT sample. Unlike ack == seq matching it works with cumulative ACKs and ACKs piggybacked on
+// data, delayed ACK is still included. Only segments with data and SYN-ACK are tracked, pure ACKs of the stratum are
+// not acknowledged, so their TSval is echoed by the next miner segment whenever it comes.
+
+// WithTimestampRTT enables RTT estimation by TCP timestamps, it is reported next to the latency of ack == seq matching
+func WithTimestampRTT(enabled bool) Opt {
+	return func(s *Service) {
+		s.timestampRTT = enabled
+	}
+}
+
+// processTimestamps remembers TSval of stratum segments and matches echoes of the miner
+func (s *shard) processTimestamps(eventTime time.Time, key connKey, isIncoming bool, pkt *tcpPacket) {
+	if !s.timestampRTT || !pkt.hasTS {
+		return
+	}
+	if !isIncoming {
+		if pkt.payloadLen == 0 && pkt.flags&tcpFlagSYN == 0 {
+			return
+		}
+		if _, ok := s.tsSent[key]; !ok {
+			s.tsSent[key] = make(map[uint32]time.Time, 16)
+		}
+		if _, ok := s.tsSent[key][pkt.tsVal]; !ok {
+			if makeRoom(s.tsSent[key], pkt.tsVal, s.maxHostEntries, timeOf) {
+				s.metrics.entriesEvicted.Add(1)
+			}
+			s.tsSent[key][pkt.tsVal] = eventTime // clock of the stratum may not tick between segments, the first one is kept
+		}
+		return
+	}
+	if pkt.tsEcr == 0 {
+		return // SYN of the miner has nothing to echo
+	}
+	sentAt, ok := s.tsSent[key][pkt.tsEcr]
+	if !ok {
+		return
+	}
+	for tsVal := range s.tsSent[key] {
+		if int32(tsVal-pkt.tsEcr) <= 0 {
+			delete(s.tsSent[key], tsVal) // older values are not echoed after the newer one
+		}
+	}
+	s.addTimestampRTT(eventTime, key, eventTime.Sub(sentAt))
+}
@@ -0,0 +1,60 @@
+package tcpmeasurer
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_TimestampRTT(t *testing.T) {
+	// given
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithTimestampRTT(true))
+	capture := newCapture(t)
+	send := func(after time.Duration, seg testSegment, tsVal, tsEcr uint32) {
+		seg.options = append([]byte{1, 1, 8, 10}, make([]byte, 8)...) // nop, nop, timestamps
+		binary.BigEndian.PutUint32(seg.options[4:8], tsVal)
+		binary.BigEndian.PutUint32(seg.options[8:12], tsEcr)
+		capture.send(captureStart.Add(after), seg)
+	}
+	confirmation := func(ack uint32) testSegment {
+		return testSegment{src: testMiner, dst: testStratum, seq: 100, ack: ack, flags: tcpFlagACK}
+	}
+
+	// when
+	send(0, response(testMiner, 1000), 500, 70)
+	send(time.Millisecond, response(testMiner, 1040), 500, 70) // clock of the stratum did not tick
+	send(2*time.Millisecond, response(testMiner, 1080), 501, 70)
+	send(42*time.Millisecond, confirmation(1120), 71, 501) // cumulative ACK of all three segments
+	send(43*time.Millisecond, confirmation(1120), 72, 500) // reordered, older value is already dropped
+	send(50*time.Millisecond, testSegment{src: testStratum, dst: testMiner, seq: 1120, ack: 100, flags: tcpFlagACK}, 510, 72)
+	send(5*time.Second, confirmation(1120), 5000, 510) // pure ACK of the stratum is not acknowledged
+	send(6*time.Second, response(testMiner, 1120), 6000, 5000)
+	send(6*time.Second+30*time.Millisecond, request(testMiner, 100, 1160, `{"id":5,"method":"mining.submit","params":["wg1.rig","BSV-1"]}`+"\n"), 5030, 6000)
+	capture.replay(srv)
+	srv.Stop()
+
+	// then
+	result := resultOf(t, sink, "wg1.rig")
+	require.Equal(t, uint64(2), result.TimestampCount)
+	require.Equal(t, float64(30), result.TimestampMin, "echo comes with the data of the miner")
+	require.Equal(t, float64(40), result.TimestampMax, "cumulative ACK echoes the latest value")
+	require.Contains(t, metricsText(t, srv), "tcpmeasurer_timestamp_samples_total 2\n")
+}
+
+func TestService_TimestampRTT_Fixture(t *testing.T) {
+	sink := &recordingSink{}
+	srv := newTestService(t, WithSinks(sink), WithLatencyUnit(time.Microsecond), WithTimestampRTT(true))
+	require.NoError(t, srv.ReadFilePureGO("samples/fixture-sll.pcap"))
+
+	srv.Stop()
+
+	results := sink.written()
+	require.NotEmpty(t, results)
+	for _, r := range results {
+		require.GreaterOrEqual(t, r.TimestampCount, r.Count, "timestamps match every exact ACK and cumulative ones")
+		require.InDelta(t, r.Median, r.TimestampMedian, r.Median*0.1, r.WorkerGroup)
+	}
+}
@@ -0,0 +1,85 @@
+package tcpmeasurer
+
+import (
+	"orchestrator/common/pkg/sketch"
+	"orchestrator/common/pkg/utils"
+	"time"
+)
+
+// windowSize is the observe interval, windows start at utils.RoundToNearest5Minutes
+const windowSize = 5 * time.Minute
+
+// WithAllowedLateness sets how long after the end of the window, by event time, samples of it are still accepted
+func WithAllowedLateness(lateness time.Duration) Opt {
+	return func(s *Service) {
+		if lateness >= 0 {
+			s.allowedLateness = lateness
+		}
+	}
+}
+
+// observeEventTime moves the watermark, it is the latest event time of captured packets
+func (s *Service) observeEventTime(eventTime time.Time) {
+	ts := eventTime.UnixNano()
+	for {
+		current := s.watermark.Load()
+		if ts <= current || s.watermark.CompareAndSwap(current, ts) {
+			return
+		}
+	}
+}
+
+func (s *Service) eventWatermark() time.Time {
+	ts := s.watermark.Load()
+	if ts == 0 {
+		return time.Time{} // nothing is captured yet, no window is closed
+	}
+	return time.Unix(0, ts)
+}
+
+func (s *Service) windowClosed(window, watermark time.Time) bool {
+	return !window.Add(windowSize + s.allowedLateness).After(watermark)
+}
+
+// addLatency saves the sample into the window of the event time, samples of closed windows are dropped.
+// Caller should observe the event time first.
+func (s *shard) addLatency(eventTime time.Time, targetHost connKey, latency time.Duration) {
+	if s.addSample(s.buffer, eventTime, targetHost, latency) {
+		s.metrics.latencySamples.Add(1)
+	}
+}
+
+// addProcessing saves time between mining.submit and the stratum response, same as addLatency
+func (s *shard) addProcessing(eventTime time.Time, targetHost connKey, processing time.Duration) {
+	if s.addSample(s.processing, eventTime, targetHost, processing) {
+		s.metrics.processingSamples.Add(1)
+	}
+}
+
+// addHandshake saves time between SYN-ACK and ACK of the connection, same as addLatency
+func (s *shard) addHandshake(eventTime time.Time, targetHost connKey, rtt time.Duration) {
+	s.addSample(s.handshakeRTT, eventTime, targetHost, rtt)
+}
+
+// addTimestampRTT saves RTT estimated by TCP timestamps, same as addLatency
+func (s *shard) addTimestampRTT(eventTime time.Time, targetHost connKey, rtt time.Duration) {
+	if s.addSample(s.tsRTT, eventTime, targetHost, rtt) {
+		s.metrics.timestampSamples.Add(1)
+	}
+}
+
+func (s *shard) addSample(buffer map[time.Time]map[connKey]*sketch.DDSketch, eventTime time.Time, targetHost connKey, value time.Duration) bool {
+	window := utils.RoundToNearest5Minutes(eventTime)
+	if s.windowClosed(window, s.eventWatermark()) {
+		s.metrics.lateSamples.Add(1)
+		return false
+	}
+	if _, ok := buffer[window]; !ok {
+		buffer[window] = make(map[connKey]*sketch.DDSketch, 5000)
+	}
+	if _, ok := buffer[window][targetHost]; !ok {
+		buffer[window][targetHost] = newLatencySketch()
+	}
+	buffer[window][targetHost].Add(float64(value))
+	return true
+}
@@ -0,0 +1,95 @@
+package tcpmeasurer
+
+import (
+	"bufio"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// feedSample passes stratum response and miner ACK through the state machine, ACK is captured at ackAt
+func feedSample(t *testing.T, srv *Service, stratum, miner netip.AddrPort, ackAt time.Time, latency time.Duration) {
+	response := testResponse(stratum, miner)
+	if c, ok := srv.shards[0].connections[connKey{miner: miner, stratum: stratum}]; ok {
+		response.seq = c.flow.sndMax // next segment of the connection, the same one is retransmission
+	}
+	confirmation := testSegment{src: miner, dst: stratum, seq: response.ack, ack: response.seq + 41, flags: tcpFlagACK}
+	replaySegments(t, srv, ackAt.Add(-latency), response)
+	replaySegments(t, srv, ackAt, confirmation)
+}
+
+func TestService_DumpIt_Watermark(t *testing.T) {
+	// given
+	recording := &recordingSink{}
+	srv := newTestService(t, WithSinks(recording), WithAllowedLateness(time.Minute))
+	at := func(minute, sec int) time.Time {
+		return time.Date(2024, 5, 31, 13, minute, sec, 0, time.UTC)
+	}
+	submit := testSegment{
+		src:     testMiner,
+		dst:     testStratum,
+		flags:   tcpFlagACK | tcpFlagPSH,
+		payload: []byte(`{"params": ["lp-wg4-s19jpro.cos-pb12-r7b1-96", "BSV-846861-89d48", "00000000"], "id": 171118, "method": "mining.submit"}`),
+	}
+	replaySegments(t, srv, at(41, 0), submit)
+	feedSample(t, srv, testStratum, testMiner, at(41, 0), 10*time.Millisecond)
+	feedSample(t, srv, testStratum, testMiner, at(45, 50), 20*time.Millisecond)
+
+	// when
+	srv.DumpIt()
+
+	// then
+	require.Empty(t, recording.results, "watermark 13:45:50 does not pass 13:40 window end plus lateness")
+
+	// when
+	feedSample(t, srv, testStratum, testMiner, at(52, 0), 30*time.Millisecond)
+	srv.DumpIt()
+
+	// then
+	require.Len(t, recording.results, 2, "all closed windows are dumped at once")
+	for i, window := range []time.Time{at(40, 0), at(45, 0)} {
+		require.Len(t, recording.results[i], 1)
+		result := recording.results[i][0]
+		require.True(t, window.Equal(result.Interval), result.Interval.String())
+		require.False(t, result.Partial)
+		require.Equal(t, uint64(1), result.Count)
+	}
+	require.InDelta(t, 10, recording.results[0][0].Max, 0.001)
+	require.InDelta(t, 20, recording.results[1][0].Max, 0.001)
+
+	// when
+	feedSample(t, srv, testStratum, testMiner, at(49, 0), 40*time.Millisecond)  // window is closed
+	feedSample(t, srv, testStratum, testMiner, at(51, 30), 50*time.Millisecond) // out of order, window is open
+	srv.DumpIt()
+	srv.flushAll()
+
+	// then
+	require.Equal(t, uint64(1), srv.metrics.lateSamples.Load())
+	require.Equal(t, uint64(1), srv.lateReported.Load(), "late samples are logged by DumpIt")
+	require.Equal(t, uint64(4), srv.metrics.latencySamples.Load())
+	require.Len(t, recording.results, 3)
+	last := recording.results[2][0]
+	require.True(t, at(50, 0).Equal(last.Interval), last.Interval.String())
+	require.True(t, last.Partial)
+	require.Equal(t, uint64(2), last.Count)
+	require.True(t, at(52, 0).Equal(srv.eventWatermark()), "watermark does not go back")
+
+	var buf strings.Builder
+	w := bufio.NewWriter(&buf)
+	srv.writeMetrics(w)
+	require.NoError(t, w.Flush())
+	require.Contains(t, buf.String(), "tcpmeasurer_late_samples_dropped_total 1\n")
+}
+
+func TestService_DumpIt_NoPackets(t *testing.T) {
+	recording := &recordingSink{}
+	srv := newTestService(t, WithSinks(recording), WithAllowedLateness(-time.Second))
+	require.Equal(t, time.Minute, srv.allowedLateness, "negative lateness is ignored")
+	require.True(t, srv.eventWatermark().IsZero())
+
+	srv.DumpIt()
+	require.Empty(t, recording.results)
+}